@@ -70,6 +70,12 @@ func afSplit(src []byte, blockNum int, h hash.Hash) ([]byte, error) {
 	return dest, nil
 }
 
+// afSplitSize returns size of the AF-split key material on disk. The material is encrypted by sectors
+// thus its size is rounded up to the sector size, see AF_split_sectors().
+func afSplitSize(keySize, stripes int) int {
+	return roundUp(keySize*stripes, storageSectorSize)
+}
+
 func afMerge(src []byte, blockSize, blockNum int, h hash.Hash) ([]byte, error) {
 	buffer := make([]byte, blockSize)
 
@@ -0,0 +1,211 @@
+package luks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/xts"
+)
+
+// sectorCipher encrypts and decrypts storage data sector by sector.
+// sectorNum is the IV sector number as it is computed by dm-crypt i.e. in 512 bytes units.
+type sectorCipher interface {
+	Encrypt(dst, src []byte, sectorNum uint64)
+	Decrypt(dst, src []byte, sectorNum uint64)
+}
+
+// parseEncryption splits the encryption specification into the cipher name and the cipher mode,
+// see crypt_parse_name_and_mode(). E.g. 'aes-cbc-essiv:sha256' is split into 'aes' and 'cbc-essiv:sha256'.
+func parseEncryption(encryption string) (string, string, error) {
+	if encryption == "null" || encryption == "cipher_null" {
+		return "cipher_null", "ecb", nil
+	}
+
+	cipherName, cipherMode, ok := strings.Cut(encryption, "-")
+	if cipherName == "" || (ok && cipherMode == "") {
+		return "", "", fmt.Errorf("Unexpected encryption format: %v", encryption)
+	}
+	if !ok || cipherMode == "plain" {
+		cipherMode = "cbc-plain"
+	}
+	return cipherName, cipherMode, nil
+}
+
+// newSectorCipher creates a cipher for the encryption specification e.g. 'aes-xts-plain64' or 'aes-cbc-essiv:sha256'
+func newSectorCipher(encryption string, key []byte) (sectorCipher, error) {
+	cipherName, cipherMode, err := parseEncryption(encryption)
+	if err != nil {
+		return nil, err
+	}
+	// the mode consists of the chaining mode and IV generator e.g. 'cbc' and 'essiv:sha256'
+	chainMode, ivMode, _ := strings.Cut(cipherMode, "-")
+
+	if cipherName == "cipher_null" {
+		if chainMode != "ecb" || ivMode != "" {
+			return nil, fmt.Errorf("Unsupported encryption mode: %v", encryption)
+		}
+		return nullCipher{}, nil
+	}
+
+	cipherFunc, err := getCipher(cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch chainMode {
+	case "xts":
+		c, err := xts.NewCipher(cipherFunc, key)
+		if err != nil {
+			return nil, err
+		}
+		switch ivMode {
+		case "plain64":
+			return c, nil
+		case "plain":
+			return xtsPlainCipher{c}, nil
+		default:
+			return nil, fmt.Errorf("Unknown IV mode for xts: %v", ivMode)
+		}
+	case "cbc":
+		block, err := cipherFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		iv, err := newIvGenerator(ivMode, cipherFunc, key)
+		if err != nil {
+			return nil, err
+		}
+		return cbcCipher{block: block, iv: iv}, nil
+	case "ecb":
+		if ivMode != "" {
+			return nil, fmt.Errorf("ecb mode does not use IV, got %v", ivMode)
+		}
+		block, err := cipherFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		return ecbCipher{block}, nil
+	default:
+		return nil, fmt.Errorf("Unknown encryption mode: %v", chainMode)
+	}
+}
+
+// xtsPlainCipher implements "xts-plain" mode that uses only lower 32 bits of the sector number as IV
+type xtsPlainCipher struct {
+	*xts.Cipher
+}
+
+func (c xtsPlainCipher) Encrypt(dst, src []byte, sectorNum uint64) {
+	c.Cipher.Encrypt(dst, src, sectorNum&0xffffffff)
+}
+
+func (c xtsPlainCipher) Decrypt(dst, src []byte, sectorNum uint64) {
+	c.Cipher.Decrypt(dst, src, sectorNum&0xffffffff)
+}
+
+type cbcCipher struct {
+	block cipher.Block
+	iv    ivGenerator
+}
+
+func (c cbcCipher) Encrypt(dst, src []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv.generate(iv, sectorNum)
+	cipher.NewCBCEncrypter(c.block, iv).CryptBlocks(dst, src)
+}
+
+func (c cbcCipher) Decrypt(dst, src []byte, sectorNum uint64) {
+	iv := make([]byte, c.block.BlockSize())
+	c.iv.generate(iv, sectorNum)
+	cipher.NewCBCDecrypter(c.block, iv).CryptBlocks(dst, src)
+}
+
+type ecbCipher struct {
+	block cipher.Block
+}
+
+func (c ecbCipher) Encrypt(dst, src []byte, _ uint64) {
+	bs := c.block.BlockSize()
+	for i := 0; i < len(src); i += bs {
+		c.block.Encrypt(dst[i:i+bs], src[i:i+bs])
+	}
+}
+
+func (c ecbCipher) Decrypt(dst, src []byte, _ uint64) {
+	bs := c.block.BlockSize()
+	for i := 0; i < len(src); i += bs {
+		c.block.Decrypt(dst[i:i+bs], src[i:i+bs])
+	}
+}
+
+// nullCipher implements "cipher_null-ecb" that keeps the data unencrypted
+type nullCipher struct{}
+
+func (nullCipher) Encrypt(dst, src []byte, _ uint64) {
+	copy(dst, src)
+}
+
+func (nullCipher) Decrypt(dst, src []byte, _ uint64) {
+	copy(dst, src)
+}
+
+// ivGenerator computes the initial vector for a sector, see IV generators in dm-crypt documentation
+type ivGenerator interface {
+	generate(iv []byte, sectorNum uint64)
+}
+
+func newIvGenerator(ivMode string, cipherFunc func(key []byte) (cipher.Block, error), key []byte) (ivGenerator, error) {
+	ivName, ivOpts, _ := strings.Cut(ivMode, ":")
+	switch ivName {
+	case "plain":
+		return plainIv{}, nil
+	case "plain64":
+		return plain64Iv{}, nil
+	case "essiv":
+		h, _ := getHashAlgo(ivOpts)
+		if h == nil {
+			return nil, fmt.Errorf("Unknown ESSIV hash algorithm: %v", ivOpts)
+		}
+		// the IV is the sector number encrypted with the hash of the volume key
+		hash := h()
+		hash.Write(key)
+		salt := hash.Sum(nil)
+		defer clearSlice(salt)
+		block, err := cipherFunc(salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ESSIV hash %v for the cipher: %v", ivOpts, err)
+		}
+		return essivIv{block}, nil
+	default:
+		return nil, fmt.Errorf("Unknown IV mode: %v", ivMode)
+	}
+}
+
+// plainIv is the 32-bit little-endian sector number padded with zeros
+type plainIv struct{}
+
+func (plainIv) generate(iv []byte, sectorNum uint64) {
+	clearSlice(iv)
+	binary.LittleEndian.PutUint32(iv, uint32(sectorNum))
+}
+
+// plain64Iv is the 64-bit little-endian sector number padded with zeros
+type plain64Iv struct{}
+
+func (plain64Iv) generate(iv []byte, sectorNum uint64) {
+	clearSlice(iv)
+	binary.LittleEndian.PutUint64(iv, sectorNum)
+}
+
+// essivIv is the 64-bit little-endian sector number encrypted with the salt (hash of the key)
+type essivIv struct {
+	block cipher.Block
+}
+
+func (e essivIv) generate(iv []byte, sectorNum uint64) {
+	clearSlice(iv)
+	binary.LittleEndian.PutUint64(iv, sectorNum)
+	e.block.Encrypt(iv, iv)
+}
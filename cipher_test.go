@@ -0,0 +1,107 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/xts"
+)
+
+func TestParseEncryption(t *testing.T) {
+	check := func(encryption, expectedName, expectedMode string) {
+		name, mode, err := parseEncryption(encryption)
+		require.NoError(t, err, encryption)
+		require.Equal(t, expectedName, name, encryption)
+		require.Equal(t, expectedMode, mode, encryption)
+	}
+
+	check("aes-xts-plain64", "aes", "xts-plain64")
+	check("aes-cbc-essiv:sha256", "aes", "cbc-essiv:sha256")
+	check("twofish-ecb", "twofish", "ecb")
+	check("aes", "aes", "cbc-plain")
+	check("aes-plain", "aes", "cbc-plain")
+	check("null", "cipher_null", "ecb")
+	check("cipher_null-ecb", "cipher_null", "ecb")
+
+	for _, e := range []string{"", "-xts-plain64", "aes-"} {
+		_, _, err := parseEncryption(e)
+		require.Error(t, err, e)
+	}
+}
+
+func TestSectorCipherInvalid(t *testing.T) {
+	key := make([]byte, 32)
+	for _, e := range []string{"foo-xts-plain64", "aes-xts-essiv:sha256", "aes-cbc-foo", "aes-cbc-essiv:foo", "aes-cbc-essiv:sha1", "aes-ecb-plain", "aes-gcm-random", "cipher_null-cbc-plain"} {
+		_, err := newSectorCipher(e, key)
+		require.Error(t, err, e)
+	}
+}
+
+// encrypts a sector with CBC mode and the given IV
+func cbcEncrypt(t *testing.T, key, iv, plaintext []byte) []byte {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	return ciphertext
+}
+
+func TestSectorCipherModes(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	plaintext := make([]byte, 1024)
+	for i := range plaintext {
+		plaintext[i] = byte(i)
+	}
+	const sector = 0x100000005
+
+	le := func(n uint64) []byte {
+		iv := make([]byte, 16)
+		binary.LittleEndian.PutUint64(iv, n)
+		return iv
+	}
+	salt := sha256.Sum256(key)
+	essivBlock, err := aes.NewCipher(salt[:])
+	require.NoError(t, err)
+	essiv := le(sector)
+	essivBlock.Encrypt(essiv, essiv)
+
+	xtsCipher, err := xts.NewCipher(aes.NewCipher, key)
+	require.NoError(t, err)
+	xtsPlain64 := make([]byte, len(plaintext))
+	xtsCipher.Encrypt(xtsPlain64, plaintext, sector)
+	xtsPlain := make([]byte, len(plaintext))
+	xtsCipher.Encrypt(xtsPlain, plaintext, 5)
+
+	ecbBlock, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	ecb := make([]byte, len(plaintext))
+	for i := 0; i < len(plaintext); i += aes.BlockSize {
+		ecbBlock.Encrypt(ecb[i:i+aes.BlockSize], plaintext[i:i+aes.BlockSize])
+	}
+
+	expected := map[string][]byte{
+		"aes-cbc-plain":        cbcEncrypt(t, key, le(5), plaintext), // only lower 32 bits of the sector are used
+		"aes-cbc-plain64":      cbcEncrypt(t, key, le(sector), plaintext),
+		"aes-cbc-essiv:sha256": cbcEncrypt(t, key, essiv, plaintext),
+		"aes-ecb":              ecb,
+		"aes-xts-plain64":      xtsPlain64,
+		"aes-xts-plain":        xtsPlain,
+		"cipher_null-ecb":      plaintext,
+	}
+	for encryption, ciphertext := range expected {
+		c, err := newSectorCipher(encryption, key)
+		require.NoError(t, err, encryption)
+
+		buf := make([]byte, len(plaintext))
+		c.Encrypt(buf, plaintext, sector)
+		require.True(t, bytes.Equal(ciphertext, buf), encryption)
+
+		c.Decrypt(buf, buf, sector)
+		require.True(t, bytes.Equal(plaintext, buf), encryption)
+	}
+}
@@ -0,0 +1,420 @@
+package luks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Convert converts the LUKS header at path to the given version (1 or 2) in place and returns the converted device.
+// It is an equivalent of `cryptsetup convert --type luks1|luks2`.
+//
+// The volume key, the keyslots and the UUID are preserved, keyslot material areas are moved as needed. Clevis luksmeta
+// slots of a LUKS1 device are converted to LUKS2 clevis tokens. Only LUKS2 devices that fit the LUKS1 format can be
+// converted back i.e. pbkdf2 keyslots with a single hash algorithm, 512 bytes sectors and no tokens.
+//
+// The keyslot material is moved in place, so the conversion cannot be crash-safe. Before the device is modified
+// its header area is written to backup (see Device.BackupHeader). If the conversion is interrupted, the device
+// is recovered with RestoreHeader(path, backup, true).
+func Convert(path string, version int, backup io.Writer) (Device, error) {
+	if backup == nil {
+		return nil, fmt.Errorf("header backup writer is required")
+	}
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("invalid LUKS version %v", version)
+	}
+
+	dev, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	if dev.Version() == version {
+		return nil, fmt.Errorf("device %v is LUKS%d already", path, version)
+	}
+
+	// the new header area is prepared and checked in memory before the device is modified
+	var headerArea []byte
+	var primarySize int
+	switch d := dev.(type) {
+	case *deviceV1:
+		headerArea, err = d.convertToV2()
+		primarySize = luks2DefaultHeaderSize
+	case *deviceV2:
+		headerArea, err = d.convertToV1()
+		primarySize = luksV1KeyslotAlignment
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(headerArea)
+	if err := checkConvertedHeader(dev, headerArea); err != nil {
+		return nil, fmt.Errorf("converted header is invalid: %v", err)
+	}
+
+	if err := dev.BackupHeader(backup); err != nil {
+		return nil, err
+	}
+
+	f, err := openForWriting(path)
+	if err != nil {
+		return nil, err
+	}
+	// the primary header is written last, after the rest of the area is on the disk
+	if err := writeSynced(f, headerArea[primarySize:], int64(primarySize)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := writeSynced(f, headerArea[:primarySize], 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	converted, err := openDevice(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return converted, nil
+}
+
+func writeSynced(f *os.File, data []byte, offset int64) error {
+	if _, err := f.WriteAt(data, offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// checkConvertedHeader parses the converted header area and compares it with the original device
+func checkConvertedHeader(dev Device, headerArea []byte) error {
+	converted, err := openDevice("", bytes.NewReader(headerArea))
+	if err != nil {
+		return err
+	}
+	if d, ok := converted.(*deviceV1); ok {
+		if err := d.hdr.validate(d.hdr.headerAreaSize()); err != nil {
+			return err
+		}
+	}
+	if converted.UUID() != dev.UUID() {
+		return fmt.Errorf("UUID %v does not match %v", converted.UUID(), dev.UUID())
+	}
+	slots, convertedSlots := dev.Slots(), converted.Slots()
+	sort.Ints(slots)
+	sort.Ints(convertedSlots)
+	if !slices.Equal(slots, convertedSlots) {
+		return fmt.Errorf("keyslots %v do not match %v", convertedSlots, slots)
+	}
+	return nil
+}
+
+// convertToV2 returns the header area with LUKS2 headers that describe the LUKS1 keyslots, see LUKS2_luks1_to_luks2().
+// The keyslot material is moved by the difference between LUKS2 and LUKS1 header sizes.
+func (d *deviceV1) convertToV2() (headerArea []byte, err error) {
+	hdr := d.hdr
+	algo := fixedArrayToString(hdr.HashSpec[:])
+	if h, _ := getHashAlgo(algo); h == nil {
+		return nil, fmt.Errorf("Unknown hash spec algorithm: %v", algo)
+	}
+	encryption := hdr.encryption()
+	keySize := uint(hdr.KeyBytes)
+
+	tokens, err := d.Tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	v1KeyslotsOffset := uint64(roundUp(binary.Size(headerV1{}), luksV1KeyslotAlignment))
+	v2KeyslotsOffset := uint64(2 * luks2DefaultHeaderSize)
+	shift := v2KeyslotsOffset - v1KeyslotsOffset
+
+	dataOffset := uint64(hdr.PayloadOffset) * storageSectorSize
+	// a detached header grows by the shift, otherwise the keyslots area spans up to the data
+	keyslotsEnd := uint64(hdr.headerAreaSize()) + shift
+	if dataOffset != 0 {
+		keyslotsEnd = dataOffset - dataOffset%luks2KeyslotAlignment
+	}
+	if keyslotsEnd <= v2KeyslotsOffset {
+		return nil, fmt.Errorf("data offset %d is too small for LUKS2 header", dataOffset)
+	}
+
+	headerArea = make([]byte, keyslotsEnd)
+	defer func() {
+		if err != nil {
+			clearSlice(headerArea)
+		}
+	}()
+	keyslotsArea := headerArea[v2KeyslotsOffset:]
+
+	meta := metadata{
+		Keyslots: map[int]keyslot{},
+		Tokens:   map[int]json.RawMessage{},
+		Segments: map[int]segment{
+			0: {
+				Type:       SegmentCrypt,
+				Offset:     jsonNumber(dataOffset),
+				IvTweak:    "0",
+				Size:       "dynamic",
+				Encryption: encryption,
+				SectorSize: storageSectorSize,
+			},
+		},
+		Digests: map[int]digest{},
+		Config: config{
+			JSONSize:     jsonNumber(luks2DefaultHeaderSize - luks2BinaryHeaderSize),
+			KeyslotsSize: jsonNumber(keyslotsEnd - v2KeyslotsOffset),
+		},
+	}
+
+	var active []int
+	for id, s := range hdr.KeySlots {
+		if s.Active != luksV1SlotEnabled {
+			continue
+		}
+
+		offset := uint64(s.KeyMaterialOffset) * storageSectorSize
+		length := uint64(afSplitSize(int(hdr.KeyBytes), int(s.Stripes)))
+		areaSize := uint64(roundUp(int(length), luks2KeyslotAlignment))
+		newOffset := offset + shift
+		if offset < v1KeyslotsOffset || newOffset+areaSize > keyslotsEnd {
+			return nil, fmt.Errorf("not enough space to move keyslot %d material", id)
+		}
+
+		material := keyslotsArea[newOffset-v2KeyslotsOffset : newOffset-v2KeyslotsOffset+length]
+		if _, err := d.f.ReadAt(material, int64(offset)); err != nil {
+			return nil, err
+		}
+
+		meta.Keyslots[id] = keyslot{
+			Type:    "luks2",
+			KeySize: keySize,
+			Af: &antiForensic{
+				Type:    "luks1",
+				Stripes: uint(s.Stripes),
+				Hash:    algo,
+			},
+			Area: area{
+				Type:       "raw",
+				Encryption: encryption,
+				KeySize:    keySize,
+				Offset:     jsonNumber(newOffset),
+				Size:       jsonNumber(areaSize),
+			},
+			Kdf: &kdf{
+				Type:       "pbkdf2",
+				Salt:       base64.StdEncoding.EncodeToString(s.Salt[:]),
+				Hash:       algo,
+				Iterations: uint(s.Iterations),
+			},
+		}
+		active = append(active, id)
+	}
+
+	meta.Digests[0] = digest{
+		Type:       "pbkdf2",
+		Keyslots:   toQuotedNumbers(active),
+		Segments:   toQuotedNumbers([]int{0}),
+		Hash:       algo,
+		Iterations: uint(hdr.MkDigestIter),
+		Salt:       base64.StdEncoding.EncodeToString(hdr.MkDigestSalt[:]),
+		Digest:     base64.StdEncoding.EncodeToString(hdr.MkDigest[:]),
+	}
+
+	for _, t := range tokens {
+		if hdr.KeySlots[t.ID].Active != luksV1SlotEnabled {
+			// stale metadata of a removed keyslot
+			continue
+		}
+		if t.Type != "clevis" {
+			return nil, fmt.Errorf("luksmeta slot %d of unknown type cannot be converted to LUKS2 token", t.ID)
+		}
+		token, err := clevisTokenFromJWE(t.ID, t.Payload)
+		if err != nil {
+			return nil, err
+		}
+		meta.Tokens[t.ID] = token
+	}
+
+	if err := writeV2Headers(memWriterAt(headerArea), newBinaryHeaderV2("", d.UUID()), &meta); err != nil {
+		return nil, err
+	}
+	return headerArea, nil
+}
+
+// clevisTokenFromJWE converts clevis luksmeta payload, a JWE in the compact serialization, to LUKS2 clevis token
+// that stores the JWE in the flattened JSON serialization
+func clevisTokenFromJWE(keyslotIdx int, payload []byte) (json.RawMessage, error) {
+	parts := strings.Split(strings.TrimSpace(string(bytes.TrimRight(payload, "\x00"))), ".")
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("clevis metadata of keyslot %d is not a compact JWE", keyslotIdx)
+	}
+
+	token := struct {
+		Type     string            `json:"type"`
+		Keyslots quotedNumbers     `json:"keyslots"`
+		Jwe      map[string]string `json:"jwe"`
+	}{
+		Type:     "clevis",
+		Keyslots: toQuotedNumbers([]int{keyslotIdx}),
+		Jwe: map[string]string{
+			"protected":     parts[0],
+			"encrypted_key": parts[1],
+			"iv":            parts[2],
+			"ciphertext":    parts[3],
+			"tag":           parts[4],
+		},
+	}
+	return json.Marshal(token)
+}
+
+// convertToV1 returns the header area with LUKS1 header and the standard keyslots layout, see LUKS2_luks2_to_luks1()
+func (d *deviceV2) convertToV1() (buf []byte, err error) {
+	if reqs := d.Requirements(); len(reqs) != 0 {
+		return nil, fmt.Errorf("device with requirements %v cannot be converted to LUKS1", reqs)
+	}
+	if len(d.meta.Tokens) != 0 {
+		return nil, fmt.Errorf("device with LUKS2 tokens cannot be converted to LUKS1")
+	}
+
+	segmentID, seg, err := d.singleCryptSegment()
+	if err != nil {
+		return nil, err
+	}
+	dataOffset, err := seg.Offset.Int64()
+	if err != nil {
+		return nil, err
+	}
+	if seg.SectorSize != storageSectorSize || seg.Size != "dynamic" || (seg.IvTweak != "" && seg.IvTweak != "0") || dataOffset%storageSectorSize != 0 {
+		return nil, fmt.Errorf("segment %d is not compatible with LUKS1", segmentID)
+	}
+
+	if len(d.meta.Digests) != 1 {
+		return nil, fmt.Errorf("LUKS1 supports a single digest, device has %d", len(d.meta.Digests))
+	}
+	var dig digest
+	for _, dg := range d.meta.Digests {
+		dig = dg
+	}
+	digestSalt, err := base64.StdEncoding.DecodeString(dig.Salt)
+	if err != nil {
+		return nil, err
+	}
+	digestValue, err := base64.StdEncoding.DecodeString(dig.Digest)
+	if err != nil {
+		return nil, err
+	}
+	algo := dig.Hash
+
+	var hdr headerV1
+	if dig.Type != "pbkdf2" || len(digestSalt) != len(hdr.MkDigestSalt) || len(digestValue) < len(hdr.MkDigest) ||
+		len(algo) >= len(hdr.HashSpec) || !dig.hasSegment(segmentID) {
+		return nil, fmt.Errorf("digest is not compatible with LUKS1")
+	}
+
+	cipherName, cipherMode, err := parseEncryption(seg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherName) >= len(hdr.CipherName) || len(cipherMode) >= len(hdr.CipherMode) {
+		return nil, fmt.Errorf("Unexpected encryption format: %v", seg.Encryption)
+	}
+
+	if len(d.meta.Keyslots) == 0 {
+		return nil, fmt.Errorf("device without keyslots cannot be converted to LUKS1")
+	}
+	var keyBytes int
+	for _, ks := range d.meta.Keyslots {
+		keyBytes = int(ks.KeySize)
+		break
+	}
+
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	hdr.Version = 1
+	copy(hdr.CipherName[:], cipherName)
+	copy(hdr.CipherMode[:], cipherMode)
+	copy(hdr.HashSpec[:], algo)
+	hdr.PayloadOffset = uint32(dataOffset / storageSectorSize)
+	hdr.KeyBytes = uint32(keyBytes)
+	copy(hdr.MkDigest[:], digestValue)
+	copy(hdr.MkDigestSalt[:], digestSalt)
+	hdr.MkDigestIter = uint32(dig.Iterations)
+	copy(hdr.UUID[:], d.UUID())
+
+	// the standard layout of keyslot material areas, the same as formatV1 uses
+	stride := roundUp(keyBytes*stripesNum, luksV1KeyslotAlignment)
+	keyslotsOffset := roundUp(binary.Size(hdr), luksV1KeyslotAlignment)
+	for i := range hdr.KeySlots {
+		hdr.KeySlots[i] = keySlot{
+			Active:            luksV1SlotDisabled,
+			KeyMaterialOffset: uint32((keyslotsOffset + i*stride) / storageSectorSize),
+			Stripes:           stripesNum,
+		}
+	}
+	areaEnd := int64(keyslotsOffset + len(hdr.KeySlots)*stride)
+	if dataOffset != 0 && areaEnd > dataOffset {
+		return nil, fmt.Errorf("LUKS1 keyslots area of size %d does not fit before data offset %d", areaEnd, dataOffset)
+	}
+
+	// the buffer overwrites the whole LUKS2 header area
+	v2AreaSize, err := headerAreaSizeV2(d.hdr, d.meta)
+	if err != nil {
+		return nil, err
+	}
+	buf = make([]byte, max(areaEnd, v2AreaSize))
+	defer func() {
+		if err != nil {
+			clearSlice(buf)
+		}
+	}()
+
+	for id, ks := range d.meta.Keyslots {
+		if id >= len(hdr.KeySlots) {
+			return nil, fmt.Errorf("keyslot %d cannot be converted, LUKS1 supports %d keyslots only", id, len(hdr.KeySlots))
+		}
+		if ks.Type != "luks2" || ks.Kdf == nil || ks.Af == nil {
+			return nil, fmt.Errorf("keyslot %d of type %v cannot be converted to LUKS1", id, ks.Type)
+		}
+		if ks.Kdf.Type != "pbkdf2" {
+			return nil, fmt.Errorf("keyslot %d uses %v, only pbkdf2 keyslots can be converted to LUKS1", id, ks.Kdf.Type)
+		}
+		salt, err := base64.StdEncoding.DecodeString(ks.Kdf.Salt)
+		if err != nil {
+			return nil, err
+		}
+
+		slot := &hdr.KeySlots[id]
+		if ks.Kdf.Hash != algo || ks.Af.Type != "luks1" || ks.Af.Hash != algo || ks.Af.Stripes != stripesNum ||
+			ks.Area.Type != "raw" || ks.Area.Encryption != seg.Encryption || ks.Area.KeySize != ks.KeySize ||
+			int(ks.KeySize) != keyBytes || len(salt) != len(slot.Salt) || !dig.hasKeyslot(id) {
+			return nil, fmt.Errorf("keyslot %d is not compatible with LUKS1", id)
+		}
+
+		areaOffset, err := ks.Area.Offset.Int64()
+		if err != nil {
+			return nil, err
+		}
+		newOffset := int(slot.KeyMaterialOffset) * storageSectorSize
+		material := buf[newOffset : newOffset+afSplitSize(keyBytes, stripesNum)]
+		if _, err := d.f.ReadAt(material, areaOffset); err != nil {
+			return nil, err
+		}
+
+		slot.Active = luksV1SlotEnabled
+		slot.Iterations = uint32(ks.Kdf.Iterations)
+		copy(slot.Salt[:], salt)
+	}
+
+	var hdrBuf bytes.Buffer
+	if err := binary.Write(&hdrBuf, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	copy(buf, hdrBuf.Bytes())
+	return buf, nil
+}
@@ -0,0 +1,166 @@
+package luks
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Decrypt decrypts the data of a LUKS2 device in place and removes the LUKS header afterwards.
+// It is an equivalent of offline `cryptsetup reencrypt --decrypt`.
+//
+// The volume key is unsealed with UnsealVolume from any keyslot that matches the passphrase. The plaintext stays
+// at the data offset and the data is not moved, so Decrypt returns the offset at which the plaintext starts on
+// the data device. It is 0 for a device with a detached header (see OpenWithHeader) that turns into a plain device,
+// otherwise the data starts right after the wiped header area. The data is processed in chunks and the progress
+// is stored in the LUKS2 metadata, so an interrupted decryption is resumed by calling Decrypt again with the same
+// passphrase. Once the data is decrypted, the metadata is reduced to a linear segment at the plaintext offset before
+// the header is wiped; if the wipe is interrupted, Decrypt finishes it and returns the recorded offset, the passphrase
+// is not checked then as no keyslots are left. The device must not be in use while it is decrypted, and dev must be
+// closed once Decrypt finishes.
+func Decrypt(dev Device, passphrase []byte, progress ReencryptProgress) (uint64, error) {
+	d, ok := dev.(*deviceV2)
+	if !ok {
+		return 0, fmt.Errorf("decryption is supported for LUKS2 devices only")
+	}
+
+	r, err := d.openReencryption()
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+
+	if r.keyslot == -1 {
+		if seg, ok := d.decryptedSegment(); ok {
+			if err := r.wipeHeader(); err != nil {
+				return 0, err
+			}
+			return seg.Offset, nil
+		}
+		err = r.initDecryption(passphrase)
+	} else if r.mode != modeDecrypt {
+		err = fmt.Errorf("reencryption in %v mode is in progress", r.mode)
+	} else {
+		err = r.load(passphrase)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := r.run(progress); err != nil {
+		return 0, err
+	}
+	return r.newSegment.Offset, nil
+}
+
+// initDecryption starts decryption: the new data layout is a linear segment at the same offset
+func (r *reencryption) initDecryption(passphrase []byte) error {
+	d := r.d
+	r.mode = modeDecrypt
+
+	_, seg, err := d.singleCryptSegment()
+	if err != nil {
+		return err
+	}
+
+	v, slot, err := unsealAny(d, passphrase)
+	if err != nil {
+		return err
+	}
+	r.oldKey, r.oldKeyslot = v.key, slot
+	r.oldDigest = d.digestForKeyslot(r.oldKeyslot)
+
+	if r.oldSegment, r.oldDynamic, err = segmentParams(seg); err != nil {
+		return err
+	}
+	r.newSegment = VolumeSegment{Type: SegmentLinear, SectorSize: storageSectorSize, Offset: r.oldSegment.Offset}
+	r.newDynamic = r.oldDynamic
+	if err := r.setDataSize(); err != nil {
+		return err
+	}
+
+	alignment := r.alignment()
+	if r.size%alignment != 0 {
+		return fmt.Errorf("data size %d is not aligned to sector size %d", r.size, alignment)
+	}
+	r.hotzoneSize = defaultHotzoneSize - defaultHotzoneSize%alignment
+
+	resilience, areaSize, err := r.resilienceArea(ResilienceChecksum, defaultReencryptHash)
+	if err != nil {
+		return err
+	}
+	areaOffset, err := d.allocateKeyslotArea(areaSize)
+	if err != nil {
+		return err
+	}
+	resilience.Offset = jsonNumber(areaOffset)
+	resilience.Size = jsonNumber(areaSize)
+
+	if err := r.addReencryptKeyslot(resilience); err != nil {
+		return err
+	}
+	if err := r.openData(); err != nil {
+		return err
+	}
+	if err := r.addReencryptDigest(); err != nil {
+		return err
+	}
+	return r.commit()
+}
+
+// decryptedSegment returns the linear segment of a device whose data is decrypted but whose header is not wiped yet
+func (d *deviceV2) decryptedSegment() (VolumeSegment, bool) {
+	if len(d.meta.Keyslots) != 0 || len(d.meta.Segments) != 1 {
+		return VolumeSegment{}, false
+	}
+	for _, seg := range d.meta.Segments {
+		if seg.Type != SegmentLinear {
+			return VolumeSegment{}, false
+		}
+		s, _, err := segmentParams(seg)
+		if err != nil {
+			return VolumeSegment{}, false
+		}
+		return s, true
+	}
+	return VolumeSegment{}, false
+}
+
+// removeHeader removes the LUKS2 header once the data is decrypted. The plaintext offset is committed to both
+// header copies first, the keyslots and the digests are dropped so that no key material is referenced anymore.
+func (r *reencryption) removeHeader() error {
+	meta := r.d.meta
+	meta.Keyslots = map[int]keyslot{}
+	meta.Digests = map[int]digest{}
+	meta.Tokens = map[int]json.RawMessage{}
+	meta.Segments = map[int]segment{0: luks2Segment(r.newSegment, 0, r.size, r.newDynamic)}
+	meta.Config.Requirements = nil
+	if err := r.d.writeHeaders(r.hf); err != nil {
+		return err
+	}
+	if err := r.hf.Sync(); err != nil {
+		return err
+	}
+	return r.wipeHeader()
+}
+
+// wipeHeader wipes the keyslots area, then the primary and the secondary header. The secondary header keeps
+// the plaintext offset until the very last step.
+func (r *reencryption) wipeHeader() error {
+	size, err := headerAreaSizeV2(r.d.hdr, r.d.meta)
+	if err != nil {
+		return err
+	}
+	headerSize := int64(r.d.hdr.HeaderSize)
+	for _, region := range []struct{ offset, size int64 }{
+		{2 * headerSize, size - 2*headerSize},
+		{0, headerSize},
+		{headerSize, headerSize},
+	} {
+		if err := wipeArea(r.hf, region.offset, region.size); err != nil {
+			return err
+		}
+		if err := r.hf.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// checkDecryptedDisk verifies that the LUKS header is removed and the plaintext is located at the given offset
+func checkDecryptedDisk(t *testing.T, path string, data []byte, offset uint64) {
+	_, err := Open(path)
+	require.Error(t, err)
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw[:offset], luks2MagicPrimary))
+	require.False(t, bytes.Contains(raw[:offset], luks2MagicSecondary))
+	require.True(t, bytes.Equal(data, raw[offset:][:len(data)]))
+}
+
+func TestDecrypt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf, SectorSize: 4096})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	_, err = dev.AddKey([]byte(password), []byte("otherpassword"), &testKdf)
+	require.NoError(t, err)
+
+	var steps []uint64
+	progress := func(done, total uint64) error {
+		require.Equal(t, uint64(len(data)), total)
+		steps = append(steps, done)
+		return nil
+	}
+	d := dev.(*deviceV2)
+	keyslotsOffset, err := d.meta.Keyslots[0].Area.Offset.Int64()
+	require.NoError(t, err)
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	require.NoError(t, err)
+	raw, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	keyslots := raw[keyslotsOffset : keyslotsOffset+keyslotsSize]
+
+	offset, err := Decrypt(dev, []byte("otherpassword"), progress)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4 * 1024 * 1024, 8 * 1024 * 1024}, steps)
+	require.NoError(t, dev.Close())
+
+	// the data is not moved, the header area in front of it is wiped
+	require.Equal(t, uint64(luks2DefaultDataOffset), offset)
+	checkDecryptedDisk(t, disk.Name(), data, offset)
+	raw, err = os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	require.Len(t, raw, luks2DefaultDataOffset+len(data))
+	require.False(t, bytes.Equal(keyslots, raw[keyslotsOffset:keyslotsOffset+keyslotsSize]))
+}
+
+func TestDecryptDetachedHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	header := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(header.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	d := dev.(*deviceV2)
+	seg := d.meta.Segments[0]
+	seg.Offset = "0"
+	d.meta.Segments[0] = seg
+	require.NoError(t, d.writeHeaders(header))
+	require.NoError(t, dev.Close())
+
+	disk := prepareEmptyDisk(t, 8*1024*1024)
+	dev, err = OpenWithHeader(header.Name(), disk.Name())
+	require.NoError(t, err)
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	data := make([]byte, v.StorageSize)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	w, err := v.NewWriterAt()
+	require.NoError(t, err)
+	_, err = w.WriteAt(data, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	offset, err := Decrypt(dev, []byte(password), nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	// the data device becomes a plain device
+	require.Zero(t, offset)
+	raw, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, raw))
+	checkDecryptedDisk(t, header.Name(), nil, luks2DefaultDataOffset)
+}
+
+func TestDecryptResume(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	_, err = Decrypt(dev, []byte(password), stopAfter(1))
+	require.Equal(t, errStopReencryption, err)
+	require.NoError(t, dev.Close())
+
+	// the device cannot be used until decryption is finished
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, []string{reencryptRequirement}, dev.Requirements())
+	var reqErr *UnsupportedRequirementError
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.ErrorAs(t, err, &reqErr)
+	require.Error(t, Reencrypt(dev, []byte(password), nil, nil))
+
+	d := dev.(*deviceV2)
+	require.Equal(t, "decrypt", d.meta.Keyslots[1].Mode)
+	require.Len(t, d.meta.Segments, 4)
+	require.Equal(t, SegmentLinear, d.meta.Segments[0].Type)
+	require.Equal(t, "4194304", d.meta.Segments[0].Size)
+	require.Equal(t, SegmentCrypt, d.meta.Segments[1].Type)
+	require.Equal(t, jsonNumber(16*1024*1024+4*1024*1024), d.meta.Segments[1].Offset)
+
+	_, err = Decrypt(dev, []byte("wrongpassword"), nil)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	// simulate a crash in the middle of the next hotzone
+	r, err := d.openReencryption()
+	require.NoError(t, err)
+	require.NoError(t, r.load([]byte(password)))
+	require.NoError(t, r.beginHotzone(r.hotzoneSize))
+	buf := make([]byte, r.hotzoneSize/2+512)
+	_, err = r.oldData.ReadAt(buf, int64(r.offset))
+	require.NoError(t, err)
+	require.NoError(t, r.writeData(buf, r.offset))
+	r.close()
+	require.NoError(t, dev.Close())
+
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	offset, err := Decrypt(dev, []byte(password), nil)
+	require.NoError(t, err)
+
+	// the offset is known after resume as well
+	require.Equal(t, uint64(luks2DefaultDataOffset), offset)
+	checkDecryptedDisk(t, disk.Name(), data, offset)
+}
+
+func TestDecryptInterruptedWipe(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	// plaintext at the data offset, as left by the decryption
+	data := make([]byte, 8*1024*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(data, luks2DefaultDataOffset)
+	require.NoError(t, err)
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	d := dev.(*deviceV2)
+	r, err := d.openReencryption()
+	require.NoError(t, err)
+	r.newSegment = VolumeSegment{Type: SegmentLinear, SectorSize: storageSectorSize, Offset: luks2DefaultDataOffset}
+	r.newDynamic = true
+	require.NoError(t, r.removeHeader())
+	r.close()
+	require.NoError(t, dev.Close())
+	_, err = Open(disk.Name())
+	require.Error(t, err)
+
+	// put back the metadata committed by removeHeader as if the wipe stopped after the primary header
+	require.Empty(t, d.meta.Keyslots)
+	require.NoError(t, d.writeHeaders(disk))
+	require.NoError(t, wipeArea(disk, 0, luks2DefaultHeaderSize))
+
+	// the offset is recovered from the secondary header
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Empty(t, dev.Slots())
+	offset, err := Decrypt(dev, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+	require.Equal(t, uint64(luks2DefaultDataOffset), offset)
+	checkDecryptedDisk(t, disk.Name(), data, offset)
+}
+
+func TestDecryptEncrypted(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+	opts := &EncryptOptions{FormatOptions: FormatOptions{KDF: testKdf}, ReduceDeviceSize: 2 * 1024 * 1024}
+	dev, err := Encrypt(disk.Name(), []byte(password), opts, nil)
+	require.NoError(t, err)
+	offset, err := Decrypt(dev, []byte(password), nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	// Encrypt shifted the data by half of ReduceDeviceSize
+	require.Equal(t, uint64(1024*1024), offset)
+	checkDecryptedDisk(t, disk.Name(), data, offset)
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	_, err = Decrypt(dev, []byte(password), nil)
+	require.Error(t, err)
+	require.NoError(t, dev.Close())
+
+	disk, _ = preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+	opts := &EncryptOptions{FormatOptions: FormatOptions{KDF: testKdf}, ReduceDeviceSize: 2 * 1024 * 1024}
+	_, err = Encrypt(disk.Name(), []byte(password), opts, stopAfter(1))
+	require.Equal(t, errStopReencryption, err)
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = Decrypt(dev, []byte(password), nil)
+	require.Error(t, err)
+}
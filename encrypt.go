@@ -0,0 +1,372 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"os"
+)
+
+// defaultReduceDeviceSize is twice the default LUKS2 data offset: half of it is the header area and
+// the other half keeps the beginning of the data while encryption is in progress
+const defaultReduceDeviceSize = 2 * luks2DefaultDataOffset
+
+// EncryptOptions specifies parameters of Encrypt
+type EncryptOptions struct {
+	// FormatOptions specifies parameters of the new LUKS2 header, Version must be either 0 or 2
+	FormatOptions
+	// ReduceDeviceSize is the size of the unused space at the end of the device, the data (e.g. a filesystem)
+	// must be shrunk by this size beforehand. The first half of it becomes the LUKS2 header area and the data
+	// is shifted by this half, the second half keeps a copy of the beginning of the data while encryption
+	// is in progress. Default is 32 MiB.
+	ReduceDeviceSize uint64
+	// HotzoneSize is the maximum size of data encrypted in one step, it cannot exceed the data shift
+	HotzoneSize uint64
+}
+
+// Encrypt converts the unencrypted device at path to LUKS2 in place and returns the new device.
+// It is an equivalent of offline `cryptsetup reencrypt --encrypt --reduce-device-size`.
+//
+// The data is moved towards the end of the device by half of opts.ReduceDeviceSize to make space for the header and
+// encrypted in chunks starting from the end. The progress is stored in the LUKS2 header, so an interrupted encryption
+// is resumed by calling Encrypt again with the same passphrase, opts other than HotzoneSize are ignored in this case.
+// The device must not be in use while it is encrypted.
+func Encrypt(path string, passphrase []byte, opts *EncryptOptions, progress ReencryptProgress) (Device, error) {
+	var o EncryptOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	dev, err := Open(path)
+	if err != nil {
+		if err := initEncryption(path, passphrase, o); err != nil {
+			return nil, err
+		}
+		if dev, err = Open(path); err != nil {
+			return nil, err
+		}
+	}
+
+	d, ok := dev.(*deviceV2)
+	if ok {
+		err = d.encrypt(passphrase, o.HotzoneSize, progress)
+	} else {
+		err = fmt.Errorf("device %v is a LUKS device already", path)
+	}
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// encrypt resumes encryption of the device
+func (d *deviceV2) encrypt(passphrase []byte, hotzoneSize uint64, progress ReencryptProgress) error {
+	r, err := d.openReencryption()
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	if r.mode != modeEncrypt {
+		return fmt.Errorf("device %v is a LUKS device already", d.path)
+	}
+	if err := r.load(passphrase); err != nil {
+		return err
+	}
+	if hotzoneSize != 0 && hotzoneSize < r.hotzoneSize {
+		r.hotzoneSize = hotzoneSize - hotzoneSize%r.alignment()
+		if r.hotzoneSize == 0 {
+			return fmt.Errorf("hotzone size %d is smaller than sector size %d", hotzoneSize, r.alignment())
+		}
+	}
+	return r.run(progress)
+}
+
+// initEncryption moves the beginning of the data to the end of the device and writes the LUKS2 header
+// with the encryption state in place of it
+func initEncryption(path string, passphrase []byte, o EncryptOptions) error {
+	format, err := o.FormatOptions.prepare()
+	if err != nil {
+		return err
+	}
+	if format.Version != 2 {
+		return fmt.Errorf("encryption is supported for LUKS2 devices only")
+	}
+	reduce := o.ReduceDeviceSize
+	if reduce == 0 {
+		reduce = defaultReduceDeviceSize
+	}
+	if reduce%(2*luks2KeyslotAlignment) != 0 {
+		return fmt.Errorf("reduce device size %d must be a multiple of %d", reduce, 2*luks2KeyslotAlignment)
+	}
+	shift := reduce / 2
+	// the header area holds the initial keyslot and the reencrypt keyslot area
+	headerSize := 2*luks2DefaultHeaderSize + uint64(roundUp(format.KeySize/8*stripesNum, luks2KeyslotAlignment)) + luks2KeyslotAlignment
+	if headerSize > shift {
+		return fmt.Errorf("reduce device size %d is too small, at least %d is required", reduce, 2*headerSize)
+	}
+	if len(format.Label) >= len(headerV2{}.Label) {
+		return fmt.Errorf("label %q is too long", format.Label)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := fileSize(f)
+	if err != nil {
+		return err
+	}
+	if size < reduce+shift {
+		return fmt.Errorf("device size %d is too small for reduce device size %d", size, reduce)
+	}
+	dataSize := size - reduce
+	if dataSize%format.SectorSize != 0 {
+		return fmt.Errorf("data size %d is not aligned to sector size %d", dataSize, format.SectorSize)
+	}
+
+	// do not overwrite a damaged LUKS header that Open failed to read
+	magic := make([]byte, len(luks2MagicPrimary))
+	if _, err := f.ReadAt(magic, 0); err != nil {
+		return err
+	}
+	if bytes.Equal(magic, luks2MagicPrimary) {
+		return fmt.Errorf("device %v contains an invalid LUKS header", path)
+	}
+	for _, offset := range luks2SecondaryHeaderOffsets {
+		if offset >= size {
+			break
+		}
+		if _, err := f.ReadAt(magic, int64(offset)); err != nil {
+			return err
+		}
+		if bytes.Equal(magic, luks2MagicSecondary) {
+			return fmt.Errorf("device %v contains an invalid LUKS header", path)
+		}
+	}
+
+	// The header area with the keyslots and the encryption state is prepared in memory first, so that invalid
+	// options fail before the data is touched.
+	movedOffset := size - shift
+	headerArea := make(memWriterAt, headerSize)
+	volumeKey := make([]byte, format.KeySize/8)
+	defer clearSlice(volumeKey)
+	if _, err := rand.Read(volumeKey); err != nil {
+		return err
+	}
+	hdr, meta, err := newV2Header(headerArea, volumeKey, passphrase, format, shift)
+	if err != nil {
+		return err
+	}
+	d := &deviceV2{path: path, f: f, hdr: hdr, meta: meta, dataPath: path, data: f}
+	areaOffset, err := d.allocateKeyslotArea(luks2KeyslotAlignment)
+	if err != nil {
+		return err
+	}
+
+	r := &reencryption{
+		d:           d,
+		hf:          f,
+		df:          f,
+		mode:        modeEncrypt,
+		oldSegment:  VolumeSegment{Type: SegmentLinear, SectorSize: storageSectorSize},
+		newSegment:  VolumeSegment{Type: SegmentCrypt, Encryption: format.Cipher, SectorSize: format.SectorSize, Offset: shift},
+		newDynamic:  true,
+		oldDigest:   -1,
+		newDigest:   0,
+		newKey:      volumeKey,
+		shift:       shift,
+		movedOffset: movedOffset,
+		size:        dataSize,
+		offset:      dataSize,
+	}
+	if r.keyslot, err = d.freeKeyslot(); err != nil {
+		return err
+	}
+	meta.Keyslots[r.keyslot] = keyslot{
+		Type:    "reencrypt",
+		KeySize: 1,
+		Area: area{
+			Type:      resilienceDatashift,
+			Offset:    jsonNumber(areaOffset),
+			Size:      jsonNumber(luks2KeyslotAlignment),
+			ShiftSize: jsonNumber(shift),
+		},
+		Mode:      modeEncrypt,
+		Direction: directionBackward,
+	}
+	meta.Config.Requirements = &requirements{Mandatory: []string{reencryptRequirement}}
+	if err := r.addReencryptDigest(); err != nil {
+		return err
+	}
+	if err := d.writeHeaders(headerArea); err != nil {
+		return err
+	}
+
+	// keep a copy of the beginning of the data in the unused space at the end of the device
+	buf := make([]byte, shift)
+	defer clearSlice(buf)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(buf, int64(movedOffset)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// From now on the header refers to the copy, the beginning of the device is not needed anymore.
+	// The rest of the header area is wiped afterwards as the unused keyslots area is never overwritten.
+	if _, err := f.WriteAt(headerArea, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(make([]byte, shift-headerSize), int64(headerSize)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// loadEncryption reads the state of encryption from the metadata, the data is shifted and encrypted backwards
+func (r *reencryption) loadEncryption(ks keyslot, passphrase []byte) error {
+	d := r.d
+	if ks.Area.Type != resilienceDatashift {
+		return fmt.Errorf("unsupported encryption resilience mode %v", ks.Area.Type)
+	}
+	shift, err := ks.Area.ShiftSize.Int64()
+	if err != nil {
+		return err
+	}
+	r.shift = uint64(shift)
+
+	previousID, finalID, movedID := -1, -1, -1
+	for id, seg := range d.meta.Segments {
+		for _, f := range seg.Flags {
+			switch f {
+			case segmentFlagBackupPrevious:
+				previousID = id
+			case segmentFlagBackupFinal:
+				finalID = id
+			case segmentFlagBackupMoved:
+				movedID = id
+			}
+		}
+	}
+	if previousID == -1 || finalID == -1 || movedID == -1 {
+		return fmt.Errorf("encryption backup segments are not found")
+	}
+
+	if r.oldSegment, r.oldDynamic, err = segmentParams(d.meta.Segments[previousID]); err != nil {
+		return err
+	}
+	if r.newSegment, r.newDynamic, err = segmentParams(d.meta.Segments[finalID]); err != nil {
+		return err
+	}
+	moved, _, err := segmentParams(d.meta.Segments[movedID])
+	if err != nil {
+		return err
+	}
+	if r.oldSegment.Type != SegmentLinear || r.oldSegment.Offset != 0 || r.oldDynamic || r.oldSegment.Size < r.shift ||
+		r.newSegment.Type != SegmentCrypt || r.newSegment.Offset != r.shift ||
+		moved.Type != SegmentLinear || moved.Size != r.shift {
+		return fmt.Errorf("invalid encryption segments layout")
+	}
+	r.movedOffset = moved.Offset
+	r.size = r.oldSegment.Size
+
+	for id, dig := range d.meta.Digests {
+		if dig.hasSegment(finalID) {
+			r.newDigest = id
+		}
+	}
+	if r.newDigest == -1 {
+		return fmt.Errorf("digest of the encrypted data is not found")
+	}
+	if err := r.unsealKeys(passphrase); err != nil {
+		return err
+	}
+	if err := r.verifyReencryptDigest(); err != nil {
+		return err
+	}
+
+	// the data is encrypted starting from the offset of the only non-backup crypt segment
+	r.offset = r.size
+	for _, seg := range d.meta.Segments {
+		if seg.isBackup() || seg.Type != SegmentCrypt {
+			continue
+		}
+		offset, err := seg.Offset.Int64()
+		if err != nil {
+			return err
+		}
+		if uint64(offset) < r.shift || uint64(offset)-r.shift > r.size {
+			return fmt.Errorf("invalid encryption segments layout")
+		}
+		r.offset = uint64(offset) - r.shift
+	}
+	alignment := r.alignment()
+	if r.offset%alignment != 0 {
+		return fmt.Errorf("invalid encryption segments layout")
+	}
+
+	// the shifted hotzone must not overlap its source
+	r.hotzoneSize = defaultHotzoneSize
+	if r.hotzoneSize > r.shift {
+		r.hotzoneSize = r.shift
+	}
+	r.hotzoneSize -= r.hotzoneSize % alignment
+	if r.hotzoneSize == 0 {
+		return fmt.Errorf("data shift %d is smaller than sector size %d", r.shift, alignment)
+	}
+
+	return r.openData()
+}
+
+// openMovedData creates the reader of the plaintext, its beginning is read from the moved segment
+func (r *reencryption) openMovedData() error {
+	moved, err := newVolumeReader(r.df, VolumeSegment{Type: SegmentLinear, Offset: r.movedOffset, Size: r.shift}, nil)
+	if err != nil {
+		return err
+	}
+	rest, err := newVolumeReader(r.df, VolumeSegment{Type: SegmentLinear, Offset: r.shift, Size: r.size - r.shift}, nil)
+	if err != nil {
+		return err
+	}
+	r.source = segmentedReader{moved, rest}
+	return nil
+}
+
+// encryptionLayout returns the segments of backward encryption ordered as [moved data][data][encrypted data]
+// followed by the backup segments. Plaintext at offset x is moved to x+shift once it is encrypted.
+func (r *reencryption) encryptionLayout() []layoutEntry {
+	moved := VolumeSegment{Type: SegmentLinear, Offset: r.movedOffset}
+
+	var entries []layoutEntry
+	if r.offset > 0 {
+		size := r.offset
+		if size > r.shift {
+			size = r.shift
+		}
+		entries = append(entries, layoutEntry{luks2Segment(moved, 0, size, false), false})
+	}
+	if r.offset > r.shift {
+		entries = append(entries, layoutEntry{luks2Segment(r.oldSegment, r.shift, r.offset-r.shift, false), false})
+	}
+	if r.offset < r.size {
+		entries = append(entries, layoutEntry{luks2Segment(r.newSegment, r.offset, r.size-r.offset, false), true})
+	}
+
+	previous := luks2Segment(r.oldSegment, 0, r.size, false)
+	previous.Flags = []string{segmentFlagBackupPrevious}
+	final := luks2Segment(r.newSegment, 0, r.size, r.newDynamic)
+	final.Flags = []string{segmentFlagBackupFinal}
+	backupMoved := luks2Segment(moved, 0, r.shift, false)
+	backupMoved.Flags = []string{segmentFlagBackupMoved}
+	return append(entries, layoutEntry{previous, false}, layoutEntry{final, true}, layoutEntry{backupMoved, false})
+}
@@ -0,0 +1,218 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// preparePlainDisk creates an unencrypted disk with random data at the beginning
+func preparePlainDisk(t *testing.T, size, dataSize int64) (*os.File, []byte) {
+	disk := prepareEmptyDisk(t, size)
+	data := make([]byte, dataSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(data, 0)
+	require.NoError(t, err)
+	return disk, data
+}
+
+// checkEncryptedDisk verifies that encryption is finished and the volume starts with the expected data
+func checkEncryptedDisk(t *testing.T, path, password string, data []byte, shift uint64) {
+	dev, err := Open(path)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	require.Empty(t, dev.Requirements())
+	d := dev.(*deviceV2)
+	require.Len(t, d.meta.Keyslots, 1)
+	require.Len(t, d.meta.Segments, 1)
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, shift, v.StorageOffset)
+	require.Equal(t, "dynamic", d.meta.Segments[0].Size)
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	decrypted := make([]byte, len(data))
+	_, err = io.ReadFull(r, decrypted)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+
+	// the copy of the beginning of the data is wiped
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, data[:4096]))
+}
+
+func TestEncrypt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+
+	var steps []uint64
+	progress := func(done, total uint64) error {
+		require.Equal(t, uint64(len(data)), total)
+		steps = append(steps, done)
+		return nil
+	}
+	opts := &EncryptOptions{
+		FormatOptions:    FormatOptions{KDF: testKdf, Label: "encrypted"},
+		ReduceDeviceSize: 2 * 1024 * 1024,
+		HotzoneSize:      4 * 1024 * 1024,
+	}
+	dev, err := Encrypt(disk.Name(), []byte(password), opts, progress)
+	require.NoError(t, err)
+	// the hotzone is limited by the data shift
+	require.Equal(t, []uint64{1 * 1024 * 1024, 2 * 1024 * 1024, 3 * 1024 * 1024, 4 * 1024 * 1024, 5 * 1024 * 1024, 6 * 1024 * 1024}, steps)
+	require.Equal(t, []int{0}, dev.Slots())
+	require.Empty(t, dev.Requirements())
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7*1024*1024), v.StorageSize)
+	require.NoError(t, dev.Close())
+
+	checkEncryptedDisk(t, disk.Name(), password, data, 1024*1024)
+}
+
+func TestEncryptDefaults(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := preparePlainDisk(t, 64*1024*1024, 32*1024*1024)
+	dev, err := Encrypt(disk.Name(), []byte(password), &EncryptOptions{FormatOptions: FormatOptions{KDF: testKdf, SectorSize: 4096}}, nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	checkEncryptedDisk(t, disk.Name(), password, data, luks2DefaultDataOffset)
+}
+
+func TestEncryptResume(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+	opts := &EncryptOptions{
+		FormatOptions:    FormatOptions{KDF: testKdf},
+		ReduceDeviceSize: 2 * 1024 * 1024,
+		HotzoneSize:      512 * 1024,
+	}
+	_, err := Encrypt(disk.Name(), []byte(password), opts, stopAfter(5))
+	require.Equal(t, errStopReencryption, err)
+
+	// the device cannot be used until encryption is finished
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, []string{reencryptRequirement}, dev.Requirements())
+	var reqErr *UnsupportedRequirementError
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.ErrorAs(t, err, &reqErr)
+
+	d := dev.(*deviceV2)
+	require.Equal(t, "encrypt", d.meta.Keyslots[1].Mode)
+	require.Len(t, d.meta.Segments, 6)
+	require.Equal(t, SegmentLinear, d.meta.Segments[0].Type)
+	require.Equal(t, jsonNumber(7*1024*1024), d.meta.Segments[0].Offset)
+	require.Equal(t, SegmentLinear, d.meta.Segments[1].Type)
+	require.Equal(t, jsonNumber(1024*1024), d.meta.Segments[1].Offset)
+	require.Equal(t, "2621440", d.meta.Segments[1].Size)
+	require.Equal(t, SegmentCrypt, d.meta.Segments[2].Type)
+	require.Equal(t, jsonNumber(1024*1024+3584*1024), d.meta.Segments[2].Offset)
+	require.Equal(t, jsonNumber(3584*1024/512), d.meta.Segments[2].IvTweak)
+	require.NoError(t, dev.Close())
+
+	// simulate a crash in the middle of the next hotzone, its destination is rewritten partially
+	garbage := make([]byte, 300*1024)
+	_, err = rand.Read(garbage)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(garbage, 1024*1024+3072*1024)
+	require.NoError(t, err)
+
+	_, err = Encrypt(disk.Name(), []byte("wrongpassword"), nil, nil)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	var steps []uint64
+	progress := func(done, total uint64) error {
+		steps = append(steps, done)
+		return nil
+	}
+	dev, err = Encrypt(disk.Name(), []byte(password), nil, progress)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3584 * 1024, 4608 * 1024, 5632 * 1024, 6 * 1024 * 1024}, steps)
+	require.NoError(t, dev.Close())
+
+	checkEncryptedDisk(t, disk.Name(), password, data, 1024*1024)
+}
+
+func TestEncryptInvalid(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+	_, err = Encrypt(disk.Name(), []byte(password), nil, nil)
+	require.Error(t, err)
+
+	disk, data := preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+	for _, opts := range []*EncryptOptions{
+		nil, // the device is too small for the default reduce size
+		{FormatOptions: FormatOptions{Version: 1}, ReduceDeviceSize: 2 * 1024 * 1024},
+		{FormatOptions: FormatOptions{KeySize: 100}, ReduceDeviceSize: 2 * 1024 * 1024},
+		{ReduceDeviceSize: 1000},
+		{ReduceDeviceSize: 64 * 1024},
+		// these options are checked only once the keyslot is created
+		{FormatOptions: FormatOptions{Cipher: "foo-xts-plain64"}, ReduceDeviceSize: 2 * 1024 * 1024},
+		{FormatOptions: FormatOptions{KDF: KDFOptions{Type: "scrypt"}}, ReduceDeviceSize: 2 * 1024 * 1024},
+		{FormatOptions: FormatOptions{KDF: KDFOptions{Type: "pbkdf2", Hash: "foo"}}, ReduceDeviceSize: 2 * 1024 * 1024},
+	} {
+		_, err := Encrypt(disk.Name(), []byte(password), opts, nil)
+		require.Error(t, err, "%+v", opts)
+	}
+
+	// the data is left intact
+	raw, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, raw[:len(data)]))
+
+	// and it can be encrypted afterwards
+	opts := &EncryptOptions{FormatOptions: FormatOptions{KDF: testKdf}, ReduceDeviceSize: 2 * 1024 * 1024}
+	dev, err = Encrypt(disk.Name(), []byte(password), opts, nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+	checkEncryptedDisk(t, disk.Name(), password, data, 1024*1024)
+}
+
+func TestEncryptCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, _ := preparePlainDisk(t, 8*1024*1024, 6*1024*1024)
+	opts := &EncryptOptions{FormatOptions: FormatOptions{KDF: testKdf}, ReduceDeviceSize: 2 * 1024 * 1024}
+	dev, err := Encrypt(disk.Name(), []byte(password), opts, nil)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Name())
+	if testing.Verbose() {
+		dumpCmd.Stdout = os.Stdout
+		dumpCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, dumpCmd.Run())
+
+	openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", disk.Name())
+	openCmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		openCmd.Stdout = os.Stdout
+		openCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, openCmd.Run())
+}
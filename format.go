@@ -0,0 +1,356 @@
+package luks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// FormatOptions specifies parameters of a LUKS device created by Format.
+// Zero value fields are replaced with defaults similar to the ones used by `cryptsetup luksFormat`.
+type FormatOptions struct {
+	// Version is the LUKS version of the new device, either 1 or 2. Default is 2.
+	Version int
+	// Cipher is the data encryption specification e.g. "aes-xts-plain64"
+	Cipher string
+	// KeySize is the size of the volume key in bits
+	KeySize int
+	// SectorSize is the encryption sector size in bytes
+	SectorSize uint64
+	// KDF specifies parameters of the key derivation function for the initial keyslot
+	KDF KDFOptions
+	// Label is an optional label of the LUKS2 device
+	Label string
+	// UUID of the new device, a random UUID is generated if it is empty
+	UUID string
+}
+
+// KDFOptions specifies parameters of the key derivation function that protects a keyslot
+type KDFOptions struct {
+	// Type is one of "pbkdf2", "argon2i" or "argon2id"
+	Type string
+	// Hash is the hash algorithm used by pbkdf2 and anti-forensic splitter
+	Hash string
+	// Iterations is the number of pbkdf2 iterations
+	Iterations uint
+	// Time is the number of argon2 iterations
+	Time uint
+	// Memory is the argon2 memory cost in KiB
+	Memory uint
+	// Threads is the argon2 parallelism
+	Threads uint
+}
+
+const (
+	defaultCipher           = "aes-xts-plain64"
+	defaultKeySize          = 512
+	defaultKdfType          = "argon2id"
+	defaultHash             = "sha256"
+	defaultPbkdf2Iterations = 1000000
+	defaultArgon2Time       = 4
+	defaultArgon2Memory     = 1024 * 1024
+	defaultArgon2Threads    = 4
+)
+
+func (o KDFOptions) withDefaults() KDFOptions {
+	if o.Type == "" {
+		o.Type = defaultKdfType
+	}
+	if o.Hash == "" {
+		o.Hash = defaultHash
+	}
+	if o.Iterations == 0 {
+		o.Iterations = defaultPbkdf2Iterations
+	}
+	if o.Time == 0 {
+		o.Time = defaultArgon2Time
+	}
+	if o.Memory == 0 {
+		o.Memory = defaultArgon2Memory
+	}
+	if o.Threads == 0 {
+		o.Threads = defaultArgon2Threads
+	}
+	return o
+}
+
+// validate checks the key derivation function type and its hash algorithm
+func (o KDFOptions) validate() error {
+	switch o.Type {
+	case "pbkdf2", "argon2i", "argon2id":
+	default:
+		return fmt.Errorf("Unknown kdf type: %v", o.Type)
+	}
+	if h, _ := getHashAlgo(o.Hash); h == nil {
+		return fmt.Errorf("Unknown hash algorithm: %v", o.Hash)
+	}
+	return nil
+}
+
+func (o FormatOptions) withDefaults() FormatOptions {
+	if o.Version == 0 {
+		o.Version = 2
+	}
+	if o.Version == 1 && o.KDF.Type == "" {
+		// LUKS1 supports pbkdf2 only
+		o.KDF.Type = "pbkdf2"
+	}
+	if o.Cipher == "" {
+		o.Cipher = defaultCipher
+	}
+	if o.KeySize == 0 {
+		o.KeySize = defaultKeySize
+	}
+	if o.SectorSize == 0 {
+		o.SectorSize = storageSectorSize
+	}
+	o.KDF = o.KDF.withDefaults()
+	return o
+}
+
+// prepare fills the default values, validates the options and generates UUID if needed
+func (o FormatOptions) prepare() (FormatOptions, error) {
+	o = o.withDefaults()
+
+	if o.KeySize <= 0 || o.KeySize%8 != 0 {
+		return o, fmt.Errorf("invalid key size %v, it must be a multiple of 8 bits", o.KeySize)
+	}
+	if o.SectorSize < storageSectorSize || o.SectorSize > 4096 || !isPowerOfTwo(uint(o.SectorSize)) {
+		return o, fmt.Errorf("invalid sector size %v", o.SectorSize)
+	}
+	if len(o.Label) >= len(headerV2{}.Label) {
+		return o, fmt.Errorf("label %q is too long", o.Label)
+	}
+	// the cipher and the key derivation function are checked before the device is modified
+	if _, err := newSectorCipher(o.Cipher, make([]byte, o.KeySize/8)); err != nil {
+		return o, err
+	}
+	if err := o.KDF.validate(); err != nil {
+		return o, err
+	}
+	if o.UUID == "" {
+		uuid, err := generateUUID()
+		if err != nil {
+			return o, err
+		}
+		o.UUID = uuid
+	} else if !isValidUUID(o.UUID) {
+		return o, fmt.Errorf("invalid UUID: %v", o.UUID)
+	}
+	return o, nil
+}
+
+// Format creates a new LUKS header at the given path (a block device or a regular file) and
+// protects the randomly generated volume key with the passphrase stored at keyslot 0.
+// It is a pure-Go equivalent of `cryptsetup luksFormat`. Note that all previous data stored
+// in the header area is destroyed.
+func Format(path string, passphrase []byte, opts *FormatOptions) (Device, error) {
+	var o FormatOptions
+	if opts != nil {
+		o = *opts
+	}
+	o, err := o.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var dev Device
+	switch o.Version {
+	case 1:
+		dev, err = formatV1(path, f, passphrase, o)
+	case 2:
+		dev, err = formatV2(path, f, passphrase, o)
+	default:
+		err = fmt.Errorf("invalid LUKS version %v", o.Version)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+func formatV1(path string, f *os.File, passphrase []byte, opts FormatOptions) (Device, error) {
+	if opts.Label != "" {
+		return nil, fmt.Errorf("labels are not supported by LUKS1")
+	}
+	if opts.SectorSize != storageSectorSize {
+		return nil, fmt.Errorf("LUKS1 supports only %v bytes sectors, got %v", storageSectorSize, opts.SectorSize)
+	}
+	if opts.KDF.Type != "pbkdf2" {
+		return nil, fmt.Errorf("LUKS1 supports only pbkdf2 key derivation function, got %v", opts.KDF.Type)
+	}
+	h, _ := getHashAlgo(opts.KDF.Hash)
+	if h == nil {
+		return nil, fmt.Errorf("Unknown hash spec algorithm: %v", opts.KDF.Hash)
+	}
+
+	var hdr headerV1
+	// LUKS1 stores cipher name and mode separately e.g. "aes" and "xts-plain64"
+	cipherName, cipherMode, err := parseEncryption(opts.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherName) >= len(hdr.CipherName) || len(cipherMode) >= len(hdr.CipherMode) {
+		return nil, fmt.Errorf("Unexpected encryption format: %v", opts.Cipher)
+	}
+
+	copy(hdr.Magic[:], "LUKS\xba\xbe")
+	hdr.Version = 1
+	copy(hdr.CipherName[:], cipherName)
+	copy(hdr.CipherMode[:], cipherMode)
+	copy(hdr.HashSpec[:], opts.KDF.Hash)
+	hdr.KeyBytes = uint32(opts.KeySize / 8)
+	copy(hdr.UUID[:], opts.UUID)
+
+	// lay out keyslot material areas right after the binary header, see LUKS_generate_phdr()
+	keyslotSectors := roundUp(int(hdr.KeyBytes)*stripesNum, luksV1KeyslotAlignment) / storageSectorSize
+	offset := roundUp(binary.Size(hdr), luksV1KeyslotAlignment) / storageSectorSize
+	for i := range hdr.KeySlots {
+		hdr.KeySlots[i] = keySlot{
+			Active:            luksV1SlotDisabled,
+			KeyMaterialOffset: uint32(offset),
+			Stripes:           stripesNum,
+		}
+		offset += keyslotSectors
+	}
+	hdr.PayloadOffset = uint32(roundUp(offset, luksV1PayloadAlignment/storageSectorSize))
+	payloadOffset := uint64(hdr.PayloadOffset) * storageSectorSize
+
+	size, err := fileSize(f)
+	if err != nil {
+		return nil, err
+	}
+	if size < payloadOffset {
+		return nil, fmt.Errorf("device %v is too small, its size %d must be at least LUKS header size %d", path, size, payloadOffset)
+	}
+
+	// wipe the old header and keyslots area
+	if _, err := f.WriteAt(make([]byte, payloadOffset), 0); err != nil {
+		return nil, err
+	}
+
+	volumeKey := make([]byte, hdr.KeyBytes)
+	defer clearSlice(volumeKey)
+	if _, err := rand.Read(volumeKey); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(hdr.MkDigestSalt[:]); err != nil {
+		return nil, err
+	}
+	hdr.MkDigestIter = digestIterations
+	mkDigest := pbkdf2.Key(volumeKey, hdr.MkDigestSalt[:], digestIterations, luksV1DigestSize, h)
+	copy(hdr.MkDigest[:], mkDigest)
+
+	d := &deviceV1{path: path, f: f, hdr: &hdr}
+	if err := d.writeKeyslot(f, 0, volumeKey, passphrase, opts.KDF.Iterations); err != nil {
+		return nil, err
+	}
+	if err := d.writeHeader(f); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	return initV1Device(path, f)
+}
+
+func formatV2(path string, f *os.File, passphrase []byte, opts FormatOptions) (Device, error) {
+	dataOffset := uint64(luks2DefaultDataOffset)
+
+	size, err := fileSize(f)
+	if err != nil {
+		return nil, err
+	}
+	if size <= dataOffset {
+		return nil, fmt.Errorf("device %v is too small, its size %d must be larger than LUKS header size %d", path, size, dataOffset)
+	}
+
+	// wipe the old header and keyslots area
+	if _, err := f.WriteAt(make([]byte, dataOffset), 0); err != nil {
+		return nil, err
+	}
+
+	volumeKey := make([]byte, opts.KeySize/8)
+	defer clearSlice(volumeKey)
+	if _, err := rand.Read(volumeKey); err != nil {
+		return nil, err
+	}
+
+	hdr, meta, err := newV2Header(f, volumeKey, passphrase, opts, dataOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeV2Headers(f, hdr, meta); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	return initV2Device(path, f)
+}
+
+// newV2Header writes keyslot 0 material that protects the volume key with the passphrase to w and returns
+// the header with a single data segment at dataOffset. The header itself is not written.
+func newV2Header(w io.WriterAt, volumeKey, passphrase []byte, opts FormatOptions, dataOffset uint64) (*headerV2, *metadata, error) {
+	hdrSize := uint64(luks2DefaultHeaderSize)
+	keyslotsOffset := 2 * hdrSize
+
+	ks, err := createLuks2Keyslot(w, 0, volumeKey, passphrase, opts.Cipher, keyslotsOffset, opts.KDF)
+	if err != nil {
+		return nil, nil, err
+	}
+	dig, err := createLuks2Digest(volumeKey, []int{0}, []int{0})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta := metadata{
+		Keyslots: map[int]keyslot{0: *ks},
+		Tokens:   map[int]json.RawMessage{},
+		Segments: map[int]segment{
+			0: {
+				Type:       "crypt",
+				Offset:     jsonNumber(dataOffset),
+				IvTweak:    "0",
+				Size:       "dynamic",
+				Encryption: opts.Cipher,
+				SectorSize: uint(opts.SectorSize),
+			},
+		},
+		Digests: map[int]digest{0: *dig},
+		Config: config{
+			JSONSize:     jsonNumber(hdrSize - luks2BinaryHeaderSize),
+			KeyslotsSize: jsonNumber(dataOffset - keyslotsOffset),
+		},
+	}
+
+	return newBinaryHeaderV2(opts.Label, opts.UUID), &meta, nil
+}
+
+// newBinaryHeaderV2 returns the binary header of a new LUKS2 device with the default header size
+func newBinaryHeaderV2(label, uuid string) *headerV2 {
+	var hdr headerV2
+	copy(hdr.Magic[:], luks2MagicPrimary)
+	hdr.Version = 2
+	hdr.HeaderSize = luks2DefaultHeaderSize
+	hdr.SequenceID = 1
+	copy(hdr.Label[:], label)
+	copy(hdr.ChecksumAlgorithm[:], "sha256")
+	copy(hdr.UUID[:], uuid)
+	return &hdr
+}
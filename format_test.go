@@ -0,0 +1,294 @@
+package luks
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fast KDF parameters to keep tests quick
+var testKdf = KDFOptions{Type: "pbkdf2", Hash: "sha256", Iterations: 1000}
+
+func prepareEmptyDisk(t *testing.T, size int64) *os.File {
+	disk, err := os.CreateTemp("", "luks.go.format.disk")
+	require.NoError(t, err)
+	require.NoError(t, disk.Truncate(size))
+	t.Cleanup(func() {
+		disk.Close()
+		os.Remove(disk.Name())
+	})
+	return disk
+}
+
+func runFormatLuks2Test(t *testing.T, opts *FormatOptions) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+
+	d, err := Format(disk.Name(), []byte(password), opts)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	d, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, 2, d.Version())
+	require.Equal(t, []int{0}, d.Slots())
+	if opts.UUID != "" {
+		require.Equal(t, opts.UUID, d.UUID())
+	}
+	if opts.Label != "" {
+		require.Equal(t, opts.Label, fixedArrayToString(d.(*deviceV2).hdr.Label[:]))
+	}
+
+	_, err = d.UnsealVolume(0, []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, uint64(8*1024*1024), v.StorageSize)
+	require.Equal(t, uint64(16*1024*1024), v.StorageOffset)
+	if opts.SectorSize != 0 {
+		require.Equal(t, opts.SectorSize, v.StorageSectorSize)
+	}
+	if opts.KeySize != 0 {
+		require.Len(t, v.key, opts.KeySize/8)
+	}
+}
+
+func TestFormatLuks2Basic(t *testing.T) {
+	runFormatLuks2Test(t, &FormatOptions{KDF: testKdf})
+}
+
+func TestFormatLuks2Params(t *testing.T) {
+	runFormatLuks2Test(t, &FormatOptions{
+		Cipher:     "aes-xts-plain64",
+		KeySize:    256,
+		SectorSize: 4096,
+		KDF:        KDFOptions{Type: "argon2id", Time: 4, Memory: 32, Threads: 1},
+		Label:      "mylabel",
+		UUID:       "462c8bc5-f997-4aa5-b97e-6346f5275521",
+	})
+}
+
+func TestFormatLuks2Argon2i(t *testing.T) {
+	runFormatLuks2Test(t, &FormatOptions{KDF: KDFOptions{Type: "argon2i", Hash: "sha512", Time: 4, Memory: 64, Threads: 2}})
+}
+
+func TestFormatLuks2CamelliaCipher(t *testing.T) {
+	runFormatLuks2Test(t, &FormatOptions{Cipher: "camellia-xts-plain64", KDF: testKdf})
+}
+
+func TestFormatLuks2SerpentCipher(t *testing.T) {
+	runFormatLuks2Test(t, &FormatOptions{Cipher: "serpent-xts-plain64", KDF: testKdf})
+}
+
+func TestFormatLuks2Pbkdf2Hashes(t *testing.T) {
+	hashes := []string{"sha1", "sha224", "sha384", "sha3-256", "ripemd160", "blake2b-512", "blake2s-256", "whirlpool", "stribog512", "sm3"}
+	for _, h := range hashes {
+		t.Run(h, func(t *testing.T) {
+			runFormatLuks2Test(t, &FormatOptions{KDF: KDFOptions{Type: "pbkdf2", Hash: h, Iterations: 1000}})
+		})
+	}
+}
+
+func TestFormatLuks2GostHashes(t *testing.T) {
+	for _, h := range []string{"stribog256", "stribog512", "sm3"} {
+		t.Run(h, func(t *testing.T) {
+			runFormatLuks2Test(t, &FormatOptions{KDF: KDFOptions{Type: "argon2id", Hash: h, Time: 4, Memory: 32, Threads: 1}})
+		})
+	}
+}
+
+// checkFormatKeepsHeader verifies that a failed Format does not modify the existing LUKS header
+func checkFormatKeepsHeader(t *testing.T, path, password string, opts *FormatOptions) {
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	_, err = Format(path, []byte("foo"), opts)
+	require.Error(t, err, "%+v", opts)
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(before, after), "%+v", opts)
+	dev, err := Open(path)
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+}
+
+func TestFormatInvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte("password"), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	for _, opts := range []*FormatOptions{
+		{UUID: "not-a-uuid", KDF: testKdf},
+		{SectorSize: 1000, KDF: testKdf},
+		{Cipher: "foo-xts-plain64", KDF: testKdf},
+		{Cipher: "aes-foo-plain64", KDF: testKdf},
+		{KeySize: 100, KDF: testKdf},
+		{KeySize: 64, KDF: testKdf},
+		{Label: strings.Repeat("a", 48), KDF: testKdf},
+		{KDF: KDFOptions{Type: "scrypt"}},
+		{KDF: KDFOptions{Type: "pbkdf2", Hash: "foo", Iterations: 1000}},
+	} {
+		checkFormatKeepsHeader(t, disk.Name(), "password", opts)
+	}
+
+	small := prepareEmptyDisk(t, 1024*1024)
+	_, err = Format(small.Name(), []byte("foo"), &FormatOptions{KDF: testKdf})
+	require.Error(t, err)
+}
+
+func TestFormatLuks2Cryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+
+	d, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer d.Close()
+
+	dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Name())
+	if testing.Verbose() {
+		dumpCmd.Stdout = os.Stdout
+		dumpCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, dumpCmd.Run())
+
+	uuid, err := blkidUUID(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, uuid, d.UUID())
+
+	openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", disk.Name())
+	openCmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		openCmd.Stdout = os.Stdout
+		openCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, openCmd.Run())
+}
+
+func runFormatLuks1Test(t *testing.T, opts *FormatOptions) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+
+	dev, err := Format(disk.Name(), []byte(password), opts)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	d, err := initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+
+	require.Equal(t, 1, d.Version())
+	require.Equal(t, []int{0}, d.Slots())
+	if opts.UUID != "" {
+		require.Equal(t, opts.UUID, d.UUID())
+	}
+
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	_, err = d.UnsealVolume(0, []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*1024*1024), v.StorageOffset)
+	require.Equal(t, uint64(2*1024*1024), v.StorageSize)
+
+	// keyslots areas are located one after another and do not overlap with the payload
+	keyslotSectors := uint32(roundUp(int(d.hdr.KeyBytes)*stripesNum, 4096) / 512)
+	for i, s := range d.hdr.KeySlots {
+		require.Equal(t, uint32(8)+uint32(i)*keyslotSectors, s.KeyMaterialOffset)
+		require.Equal(t, uint32(stripesNum), s.Stripes)
+	}
+	require.LessOrEqual(t, d.hdr.KeySlots[7].KeyMaterialOffset+keyslotSectors, d.hdr.PayloadOffset)
+}
+
+func TestFormatLuks1Basic(t *testing.T) {
+	runFormatLuks1Test(t, &FormatOptions{Version: 1, KDF: KDFOptions{Iterations: 1000}})
+}
+
+func TestFormatLuks1Params(t *testing.T) {
+	runFormatLuks1Test(t, &FormatOptions{
+		Version: 1,
+		Cipher:  "twofish-xts-plain64",
+		KeySize: 256,
+		KDF:     KDFOptions{Type: "pbkdf2", Hash: "sha512", Iterations: 1000},
+		UUID:    "462c8bc5-f997-4aa5-b97e-6346f5275521",
+	})
+}
+
+func TestFormatLuks1GostHashes(t *testing.T) {
+	for _, h := range []string{"stribog256", "stribog512", "sm3"} {
+		t.Run(h, func(t *testing.T) {
+			runFormatLuks1Test(t, &FormatOptions{Version: 1, KDF: KDFOptions{Type: "pbkdf2", Hash: h, Iterations: 1000}})
+		})
+	}
+}
+
+func TestFormatLuks1InvalidOptions(t *testing.T) {
+	t.Parallel()
+
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte("password"), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	for _, opts := range []*FormatOptions{
+		{Version: 1, KDF: KDFOptions{Type: "argon2id"}},
+		{Version: 1, Label: "label", KDF: testKdf},
+		{Version: 1, SectorSize: 4096, KDF: testKdf},
+		{Version: 3, KDF: testKdf},
+		{Version: 1, Cipher: "bogus-xts-plain64", KDF: testKdf},
+		{Version: 1, KDF: KDFOptions{Type: "pbkdf2", Hash: "foo", Iterations: 1000}},
+	} {
+		checkFormatKeepsHeader(t, disk.Name(), "password", opts)
+	}
+}
+
+func TestFormatLuks1Cryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+
+	d, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer d.Close()
+
+	dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Name())
+	if testing.Verbose() {
+		dumpCmd.Stdout = os.Stdout
+		dumpCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, dumpCmd.Run())
+
+	uuid, err := blkidUUID(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, uuid, d.UUID())
+
+	openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", disk.Name())
+	openCmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		openCmd.Stdout = os.Stdout
+		openCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, openCmd.Run())
+}
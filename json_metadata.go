@@ -1,14 +1,21 @@
 package luks
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strconv"
+)
 
 type keyslot struct {
-	Type     string       `json:"type"`
-	KeySize  uint         `json:"key_size"`
-	Af       antiForensic `json:"af"`
-	Area     area         `json:"area"`
-	Kdf      kdf          `json:"kdf"`
-	Priority *int         `json:"priority"` // need to distinguish 0 (ignore) from absence of the field (normal priority)
+	Type     string        `json:"type"`
+	KeySize  uint          `json:"key_size"`
+	Af       *antiForensic `json:"af,omitempty"`
+	Area     area          `json:"area"`
+	Kdf      *kdf          `json:"kdf,omitempty"`
+	Priority *int          `json:"priority,omitempty"` // need to distinguish 0 (ignore) from absence of the field (normal priority)
+
+	// reencrypt keyslot fields
+	Mode      string `json:"mode,omitempty"`
+	Direction string `json:"direction,omitempty"`
 }
 
 type antiForensic struct {
@@ -19,10 +26,15 @@ type antiForensic struct {
 
 type area struct {
 	Type       string      `json:"type"`
-	Encryption string      `json:"encryption"`
-	KeySize    uint        `json:"key_size"`
-	Offset     json.Number `json:"offset"`
-	Size       json.Number `json:"size"`
+	Encryption string      `json:"encryption,omitempty"`
+	KeySize    uint        `json:"key_size,omitempty"`
+	Offset     json.Number `json:"offset,string"`
+	Size       json.Number `json:"size,string"`
+
+	// reencryption resilience area fields
+	Hash       string      `json:"hash,omitempty"`
+	SectorSize uint        `json:"sector_size,omitempty"`
+	ShiftSize  json.Number `json:"shift_size,omitempty,string"`
 }
 
 type kdf struct {
@@ -30,28 +42,29 @@ type kdf struct {
 	Salt string `json:"salt"`
 
 	// pbkdf2 specific fields
-	Hash       string `json:"hash"`
-	Iterations uint   `json:"iterations"`
+	Hash       string `json:"hash,omitempty"`
+	Iterations uint   `json:"iterations,omitempty"`
 
 	// argon2i fields
-	Time   uint `json:"time"`
-	Memory uint `json:"memory"`
-	Cpus   uint `json:"cpus"`
+	Time   uint `json:"time,omitempty"`
+	Memory uint `json:"memory,omitempty"`
+	Cpus   uint `json:"cpus,omitempty"`
 }
 
 type segment struct {
 	Type       string      `json:"type"`
-	Offset     json.Number `json:"offset"`
-	IvTweak    json.Number `json:"iv_tweak"`
+	Offset     json.Number `json:"offset,string"`
+	IvTweak    json.Number `json:"iv_tweak,omitempty,string"`
 	Size       string      `json:"size"` // either 'dynamic' or uint
-	Encryption string      `json:"encryption"`
-	SectorSize uint        `json:"sector_size"`
+	Encryption string      `json:"encryption,omitempty"`
+	SectorSize uint        `json:"sector_size,omitempty"`
+	Flags      []string    `json:"flags,omitempty"`
 }
 
 type digest struct {
 	Type       string        `json:"type"`
-	Keyslots   []json.Number `json:"keyslots"`
-	Segments   []json.Number `json:"segments"`
+	Keyslots   quotedNumbers `json:"keyslots"`
+	Segments   quotedNumbers `json:"segments"`
 	Hash       string        `json:"hash"`
 	Iterations uint          `json:"iterations"`
 	Salt       string        `json:"salt"`
@@ -59,10 +72,14 @@ type digest struct {
 }
 
 type config struct {
-	JSONSize     json.Number `json:"json_size"`
-	KeyslotsSize json.Number `json:"keyslots_size"`
-	Flags        []string    `json:"flags"`
-	Requirements []string    `json:"requirements"`
+	JSONSize     json.Number   `json:"json_size,string"`
+	KeyslotsSize json.Number   `json:"keyslots_size,string"`
+	Flags        []string      `json:"flags,omitempty"`
+	Requirements *requirements `json:"requirements,omitempty"`
+}
+
+type requirements struct {
+	Mandatory []string `json:"mandatory,omitempty"`
 }
 
 type metadata struct {
@@ -72,3 +89,38 @@ type metadata struct {
 	Digests  map[int]digest          `json:"digests"`
 	Config   config                  `json:"config"`
 }
+
+// quotedNumbers is a list of ids that LUKS2 JSON stores as strings, e.g. `"keyslots": ["0", "1"]`
+type quotedNumbers []json.Number
+
+func (q quotedNumbers) MarshalJSON() ([]byte, error) {
+	values := make([]string, len(q))
+	for i, n := range q {
+		values[i] = n.String()
+	}
+	return json.Marshal(values)
+}
+
+func jsonNumber(n uint64) json.Number {
+	return json.Number(strconv.FormatUint(n, 10))
+}
+
+func toQuotedNumbers(ids []int) quotedNumbers {
+	result := make(quotedNumbers, len(ids))
+	for i, id := range ids {
+		result[i] = json.Number(strconv.Itoa(id))
+	}
+	return result
+}
+
+// without returns a copy of the list with the given id removed
+func (q quotedNumbers) without(id int) quotedNumbers {
+	result := make(quotedNumbers, 0, len(q))
+	for _, n := range q {
+		if v, err := n.Int64(); err == nil && int(v) == id {
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
@@ -20,4 +20,16 @@ func parseMetadata(t *testing.T, filename string) {
 func TestParseMetadata(t *testing.T) {
 	parseMetadata(t, "testdata/metadata/1.json")
 	parseMetadata(t, "testdata/metadata/2.json")
+	parseMetadata(t, "testdata/metadata/3.json")
+}
+
+func TestParseMetadataRequirements(t *testing.T) {
+	data, err := os.ReadFile("testdata/metadata/3.json")
+	require.NoError(t, err)
+
+	var meta metadata
+	require.NoError(t, json.Unmarshal(data, &meta))
+	require.Equal(t, []string{"online-reencrypt-v2"}, meta.Config.Requirements.Mandatory)
+	require.Equal(t, "reencrypt", meta.Keyslots[2].Type)
+	require.Len(t, meta.Segments, 4)
 }
@@ -2,6 +2,7 @@ package luks
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -12,19 +13,40 @@ import (
 // ErrPassphraseDoesNotMatch is an error that indicates provided passphrase does not match
 var ErrPassphraseDoesNotMatch = fmt.Errorf("Passphrase does not match")
 
+// ErrLastKeyslot is an error that indicates an attempt to remove the last keyslot that protects the volume key
+var ErrLastKeyslot = fmt.Errorf("Refusing to remove the last keyslot")
+
+// UnsupportedRequirementError is an error that indicates the LUKS2 device has a mandatory requirement
+// (e.g. it is in the middle of reencryption) that is not implemented by this library. Such devices are refused
+// to be unsealed or modified as it might lead to data corruption.
+type UnsupportedRequirementError struct {
+	Requirement string
+}
+
+func (e *UnsupportedRequirementError) Error() string {
+	return fmt.Sprintf("unsupported LUKS2 requirement: %v", e.Requirement)
+}
+
 // Device represents LUKS partition data
 type Device interface {
 	io.Closer
 	// Version returns version of LUKS disk
 	Version() int
-	// Path returns block device path
+	// Path returns block device path. If a detached header is used then it is the path of the header file.
 	Path() string
+	// HeaderOffset returns offset of the header copy the metadata was read from.
+	// It is non-zero if the primary LUKS2 header is damaged or outdated and the secondary copy is used instead.
+	HeaderOffset() uint64
 	// UUID returns UUID of the LUKS partition
 	UUID() string
 	// Slots returns list of all active slots for this device sorted by priority
 	Slots() []int
 	// Tokens returns list of available tokens (metadata) for slots
 	Tokens() ([]Token, error)
+	// Requirements returns list of LUKS2 mandatory requirements e.g. "online-reencrypt-v2".
+	// The device cannot be unsealed or modified if any of the requirements is not supported,
+	// in this case UnsupportedRequirementError is returned.
+	Requirements() []string
 	// FlagsGet get the list of LUKS flags (options) used during unlocking
 	FlagsGet() []string
 	// FlagsAdd adds LUKS flags used for the upcoming unlocking
@@ -46,6 +68,39 @@ type Device interface {
 	Unlock(keyslot int, passphrase []byte, dmName string) error
 	// UnlockAny iterates over all available slots and tries to unlock them until succeeds
 	UnlockAny(passphrase []byte, dmName string) error
+	// UnlockWithTokens recovers a passphrase from the device tokens with handlers registered by RegisterTokenHandler
+	// and sets up the mapper device. Tokens are tried in the order of their ids, each against its keyslots in
+	// priority order. If no token unlocks the device then the returned error wraps ErrNoUsableToken.
+	UnlockWithTokens(ctx context.Context, dmName string) error
+
+	// AddKey recovers the volume key using an existing passphrase and stores it in a free keyslot protected
+	// by the new passphrase. It returns id of the new keyslot. This is an equivalent of `cryptsetup luksAddKey`.
+	// If opts is nil then default KDF parameters are used, note that LUKS1 supports pbkdf2 only.
+	AddKey(existingPassphrase, newPassphrase []byte, opts *KDFOptions) (int, error)
+	// KillSlot wipes the key material of the keyslot and removes it from the header, it is an equivalent
+	// of `cryptsetup luksKillSlot`. Removing the last keyslot makes the volume unrecoverable thus it fails
+	// with ErrLastKeyslot unless force is set.
+	KillSlot(keyslot int, force bool) error
+	// ChangeKey replaces the passphrase of the keyslot, it is an equivalent of `cryptsetup luksChangeKey`.
+	// If opts is nil then the keyslot keeps its current KDF parameters.
+	ChangeKey(keyslot int, oldPassphrase, newPassphrase []byte, opts *KDFOptions) error
+	// RemoveKey finds the keyslot that matches the passphrase and kills it, see KillSlot.
+	// It is an equivalent of `cryptsetup luksRemoveKey`.
+	RemoveKey(passphrase []byte, force bool) error
+
+	// TokenImport stores the token in the header and returns its id, it is an equivalent of `cryptsetup token import`.
+	// If token.ID is negative then the lowest free id is used. LUKS2 token payload is a JSON object, its "type"
+	// and "keyslots" fields are set from token.Type and token.Slots. LUKS1 supports clevis tokens only, such token
+	// refers to a single keyslot and is stored in the luksmeta slot with the same id.
+	TokenImport(token Token) (int, error)
+	// TokenExport returns the token with the given id, it is an equivalent of `cryptsetup token export`.
+	TokenExport(id int) (Token, error)
+	// TokenRemove removes the token from the header, it is an equivalent of `cryptsetup token remove`.
+	TokenRemove(id int) error
+
+	// BackupHeader writes the whole header area (binary headers, metadata and keyslots material) to w.
+	// It is an equivalent of `cryptsetup luksHeaderBackup`, see RestoreHeader.
+	BackupHeader(w io.Writer) error
 }
 
 // List of options handled by luks.go API.
@@ -75,28 +130,179 @@ func Open(path string) (Device, error) {
 		return nil, err
 	}
 
+	dev, err := openDevice(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// OpenReaderAt reads LUKS headers from a random-access source of the given size e.g. an image stored
+// in an archive or in a cloud storage. Devices opened this way are read-only, and volumes unsealed from
+// such devices cannot be used with SetupMapper as there is no block device path to map.
+// Closing the device does not close r.
+func OpenReaderAt(r io.ReaderAt, size int64) (Device, error) {
+	return openDevice("", io.NewSectionReader(r, 0, size))
+}
+
+func openDevice(path string, r io.ReaderAt) (Device, error) {
 	// LUKS Magic and version are stored in the first 8 bytes of the LUKS header
 	header := make([]byte, 8)
-	if _, err := f.ReadAt(header[:], 0); err != nil {
+	if _, err := r.ReadAt(header[:], 0); err != nil {
 		return nil, err
 	}
 
 	// verify header magic
 	if !bytes.Equal(header[0:6], []byte("LUKS\xba\xbe")) {
+		// the primary header might be damaged, try to find LUKS2 secondary header
+		if dev, err := initV2Device(path, r); err == nil {
+			return dev, nil
+		}
 		return nil, fmt.Errorf("invalid LUKS header")
 	}
 
 	version := int(header[6])<<8 + int(header[7])
 	switch version {
 	case 1:
-		return initV1Device(path, f)
+		return initV1Device(path, r)
 	case 2:
-		return initV2Device(path, f)
+		return initV2Device(path, r)
 	default:
 		return nil, fmt.Errorf("invalid LUKS version %v", version)
 	}
 }
 
+// OpenWithHeader reads LUKS metadata from a detached header (a file or a block device) at headerPath
+// while the encrypted data is located at dataPath. It is an equivalent of `cryptsetup --header`.
+func OpenWithHeader(headerPath, dataPath string) (Device, error) {
+	dev, err := Open(headerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.Open(dataPath)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	switch d := dev.(type) {
+	case *deviceV1:
+		d.dataPath, d.data = dataPath, data
+	case *deviceV2:
+		d.dataPath, d.data = dataPath, data
+	}
+	return dev, nil
+}
+
+// openForWriting opens the header storage for modification
+func openForWriting(path string) (*os.File, error) {
+	if path == "" {
+		return nil, fmt.Errorf("device opened with OpenReaderAt is read-only")
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// closeStorage closes files opened by Open or OpenWithHeader.
+// Readers passed to OpenReaderAt (i.e. there is no path) are owned by the caller.
+func closeStorage(path string, header, data io.ReaderAt) error {
+	if path == "" {
+		return nil
+	}
+	if data != header {
+		if c, ok := data.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if c, ok := header.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// RestoreHeader writes the header backup created by Device.BackupHeader to the device at path.
+// It is an equivalent of `cryptsetup luksHeaderRestore`. The backup is validated before writing, and if
+// the device contains a LUKS header already then its UUID must match the backup UUID.
+// If the device does not contain a readable LUKS header (it is damaged, or path refers to a wrong device)
+// then the backup is written only if force is true, the data at the beginning of the device is overwritten.
+func RestoreHeader(path string, r io.Reader, force bool) error {
+	backup, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var uuid string
+	if len(backup) >= 8 && bytes.Equal(backup[0:6], []byte("LUKS\xba\xbe")) && backup[6] == 0 && backup[7] == 1 {
+		dev, err := initV1Device("", bytes.NewReader(backup))
+		if err != nil {
+			return fmt.Errorf("invalid LUKS header backup: %v", err)
+		}
+		if err := dev.hdr.validate(int64(len(backup))); err != nil {
+			return fmt.Errorf("invalid LUKS header backup: %v", err)
+		}
+		uuid = dev.UUID()
+	} else {
+		hdr, meta, err := readHeadersV2(bytes.NewReader(backup))
+		if err != nil {
+			return fmt.Errorf("invalid LUKS header backup: %v", err)
+		}
+		size, err := headerAreaSizeV2(hdr, meta)
+		if err != nil {
+			return err
+		}
+		if int64(len(backup)) != size {
+			return fmt.Errorf("header backup size mismatch, expected %d bytes, got %d", size, len(backup))
+		}
+		uuid = fixedArrayToString(hdr.UUID[:])
+	}
+
+	if dev, err := Open(path); err == nil {
+		devUUID := dev.UUID()
+		dev.Close()
+		if devUUID != uuid {
+			return fmt.Errorf("header backup UUID %v does not match device UUID %v", uuid, devUUID)
+		}
+	} else if !force {
+		return fmt.Errorf("device %v does not contain a valid LUKS header (%v), use force to overwrite it", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := fileSize(f)
+	if err != nil {
+		return err
+	}
+	if size < uint64(len(backup)) {
+		return fmt.Errorf("device %v is too small for the header backup of size %d", path, len(backup))
+	}
+
+	if _, err := f.WriteAt(backup, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// unsealAny iterates over all active keyslots and returns the volume unsealed with the passphrase
+// together with the keyslot id
+func unsealAny(d Device, passphrase []byte) (*Volume, int, error) {
+	for _, s := range d.Slots() {
+		volume, err := d.UnsealVolume(s, passphrase)
+		if err == ErrPassphraseDoesNotMatch {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		return volume, s, nil
+	}
+	return nil, 0, ErrPassphraseDoesNotMatch
+}
+
 // Lock closes device mapper partition with the given name
 func Lock(name string) error {
 	return devmapper.Remove(name)
@@ -2,16 +2,16 @@ package luks
 
 import (
 	"bytes"
-	"crypto/cipher"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"hash"
 	"hash/crc32"
-	"os"
+	"io"
 	"unsafe"
 
 	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 )
 
 // LUKS v1 format is specified here
@@ -39,36 +39,50 @@ type keySlot struct {
 	Stripes           uint32
 }
 
-const luksV1SlotEnabled = 0xAC71F3
+const (
+	luksV1SlotEnabled  = 0xAC71F3
+	luksV1SlotDisabled = 0xDEAD
+	// keyslot material areas are aligned to this value, see LUKS_ALIGN_KEYSLOTS
+	luksV1KeyslotAlignment = 4096
+	// default alignment of the payload
+	luksV1PayloadAlignment = 1024 * 1024
+	// size of the header MkDigest field
+	luksV1DigestSize = 20
+)
 
 type deviceV1 struct {
-	path  string
-	f     *os.File
+	path  string      // empty if the device is opened with OpenReaderAt
+	f     io.ReaderAt // header storage
 	hdr   *headerV1
 	flags []string
+	// data storage, it differs from the header storage if a detached header is used
+	dataPath string
+	data     io.ReaderAt
 }
 
-func initV1Device(path string, f *os.File) (*deviceV1, error) {
+func initV1Device(path string, f io.ReaderAt) (*deviceV1, error) {
 	var hdr headerV1
 
-	if _, err := f.Seek(0, 0); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
+	if err := binary.Read(io.NewSectionReader(f, 0, int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
 		return nil, err
 	}
 
-	return &deviceV1{path: path, f: f, hdr: &hdr}, nil
+	return &deviceV1{path: path, f: f, hdr: &hdr, dataPath: path, data: f}, nil
 }
 
 func (d *deviceV1) Close() error {
-	return d.f.Close()
+	return closeStorage(d.path, d.f, d.data)
 }
 
 func (d *deviceV1) Path() string {
 	return d.path
 }
 
+func (d *deviceV1) HeaderOffset() uint64 {
+	// LUKS1 has only one header
+	return 0
+}
+
 func (d *deviceV1) Slots() []int {
 	slots := make([]int, 0)
 
@@ -83,6 +97,11 @@ func (d *deviceV1) Slots() []int {
 	return slots
 }
 
+// Requirements returns nil as LUKS1 does not have requirements
+func (d *deviceV1) Requirements() []string {
+	return nil
+}
+
 func (d *deviceV1) UUID() string {
 	return fixedArrayToString(d.hdr.UUID[:])
 }
@@ -132,6 +151,178 @@ func (d *deviceV1) UnlockAny(passphrase []byte, dmName string) error {
 	return ErrPassphraseDoesNotMatch
 }
 
+func (d *deviceV1) UnlockWithTokens(ctx context.Context, dmName string) error {
+	return unlockWithTokens(ctx, d, dmName)
+}
+
+func (d *deviceV1) AddKey(existingPassphrase, newPassphrase []byte, opts *KDFOptions) (int, error) {
+	var o KDFOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Type == "" {
+		o.Type = "pbkdf2"
+	}
+	if err := d.checkKdfHash(o); err != nil {
+		return 0, err
+	}
+	o = o.withDefaults()
+	if o.Type != "pbkdf2" {
+		return 0, fmt.Errorf("LUKS1 supports only pbkdf2 key derivation function, got %v", o.Type)
+	}
+
+	newSlot := -1
+	for i, s := range d.hdr.KeySlots {
+		if s.Active != luksV1SlotEnabled {
+			newSlot = i
+			break
+		}
+	}
+	if newSlot == -1 {
+		return 0, fmt.Errorf("no free keyslots available")
+	}
+
+	volume, _, err := unsealAny(d, existingPassphrase)
+	if err != nil {
+		return 0, err
+	}
+	defer clearSlice(volume.key)
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// the keyslot is restored if the header is not written
+	slot := d.hdr.KeySlots[newSlot]
+	if err := d.writeKeyslot(f, newSlot, volume.key, newPassphrase, o.Iterations); err != nil {
+		d.hdr.KeySlots[newSlot] = slot
+		return 0, err
+	}
+	if err := d.writeHeader(f); err != nil {
+		d.hdr.KeySlots[newSlot] = slot
+		return 0, err
+	}
+	return newSlot, f.Sync()
+}
+
+// checkKdfHash returns an error if the options request a hash other than the one of the header,
+// LUKS1 uses a single hash algorithm for all keyslots
+func (d *deviceV1) checkKdfHash(o KDFOptions) error {
+	if hash := fixedArrayToString(d.hdr.HashSpec[:]); o.Hash != "" && o.Hash != hash {
+		return fmt.Errorf("LUKS1 header uses %v hash for all keyslots, got %v", hash, o.Hash)
+	}
+	return nil
+}
+
+func (d *deviceV1) KillSlot(keyslotIdx int, force bool) error {
+	if keyslotIdx < 0 || keyslotIdx >= len(d.hdr.KeySlots) {
+		return fmt.Errorf("keyslot %d is out of range of available slots", keyslotIdx)
+	}
+	slot := &d.hdr.KeySlots[keyslotIdx]
+	if slot.Active != luksV1SlotEnabled {
+		return fmt.Errorf("keyslot %d is not active", keyslotIdx)
+	}
+	if !force && len(d.Slots()) == 1 {
+		return ErrLastKeyslot
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keyslotSize := afSplitSize(int(d.hdr.KeyBytes), int(slot.Stripes))
+	if err := wipeArea(f, int64(slot.KeyMaterialOffset)*storageSectorSize, int64(keyslotSize)); err != nil {
+		return err
+	}
+
+	slot.Active = luksV1SlotDisabled
+	slot.Iterations = 0
+	clearSlice(slot.Salt[:])
+	if err := d.writeHeader(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (d *deviceV1) ChangeKey(keyslotIdx int, oldPassphrase, newPassphrase []byte, opts *KDFOptions) error {
+	volume, err := d.UnsealVolume(keyslotIdx, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+
+	iterations := uint(d.hdr.KeySlots[keyslotIdx].Iterations)
+	if opts != nil {
+		o := *opts
+		if o.Type == "" {
+			o.Type = "pbkdf2"
+		}
+		if err := d.checkKdfHash(o); err != nil {
+			return err
+		}
+		o = o.withDefaults()
+		if o.Type != "pbkdf2" {
+			return fmt.Errorf("LUKS1 supports only pbkdf2 key derivation function, got %v", o.Type)
+		}
+		iterations = o.Iterations
+	}
+
+	// modify a copy of the header and apply it only once it is written
+	hdr := *d.hdr
+	newDev := &deviceV1{path: d.path, f: d.f, hdr: &hdr, dataPath: d.dataPath, data: d.data}
+
+	// If there is an inactive keyslot then write the new key material to its area and swap the areas.
+	// This way the old passphrase stays valid until the header is updated.
+	spare := -1
+	for i, s := range hdr.KeySlots {
+		if s.Active != luksV1SlotEnabled && s.Stripes == hdr.KeySlots[keyslotIdx].Stripes {
+			spare = i
+			break
+		}
+	}
+	if spare != -1 {
+		slot, spareSlot := &hdr.KeySlots[keyslotIdx], &hdr.KeySlots[spare]
+		slot.KeyMaterialOffset, spareSlot.KeyMaterialOffset = spareSlot.KeyMaterialOffset, slot.KeyMaterialOffset
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := newDev.writeKeyslot(f, keyslotIdx, volume.key, newPassphrase, iterations); err != nil {
+		return err
+	}
+	if err := newDev.writeHeader(f); err != nil {
+		return err
+	}
+	*d.hdr = hdr
+
+	if spare != -1 {
+		oldSlot := hdr.KeySlots[spare]
+		keyslotSize := afSplitSize(int(hdr.KeyBytes), int(oldSlot.Stripes))
+		if err := wipeArea(f, int64(oldSlot.KeyMaterialOffset)*storageSectorSize, int64(keyslotSize)); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+func (d *deviceV1) RemoveKey(passphrase []byte, force bool) error {
+	volume, slot, err := unsealAny(d, passphrase)
+	if err != nil {
+		return err
+	}
+	clearSlice(volume.key)
+
+	return d.KillSlot(slot, force)
+}
+
 func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
 	keyslots := d.hdr.KeySlots
 	if keyslotIdx < 0 || keyslotIdx >= len(keyslots) {
@@ -160,11 +351,11 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 		return nil, ErrPassphraseDoesNotMatch
 	}
 
-	encryption := fixedArrayToString(d.hdr.CipherName[:]) + "-" + fixedArrayToString(d.hdr.CipherMode[:])
+	encryption := d.hdr.encryption()
 
 	storageOffset := uint64(d.hdr.PayloadOffset) * storageSectorSize
 
-	storageSize, err := fileSize(d.f)
+	storageSize, err := readerSize(d.data)
 	if err != nil {
 		return nil, err
 	}
@@ -174,7 +365,7 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 	storageSize -= storageOffset
 
 	v := Volume{
-		BackingDevice:     d.path,
+		BackingDevice:     d.dataPath,
 		Flags:             d.flags,
 		UUID:              d.UUID(),
 		key:               finalKey,
@@ -184,6 +375,7 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 		StorageEncryption: encryption,
 		StorageIvTweak:    0,
 		StorageSectorSize: storageSectorSize,
+		backing:           d.data,
 	}
 
 	return &v, nil
@@ -191,50 +383,167 @@ func (d *deviceV1) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, err
 
 func (d *deviceV1) decryptLuks1VolumeKey(keyslotIdx int, slot keySlot, afKey []byte, h func() hash.Hash) ([]byte, error) {
 	// decrypt keyslotIdx area using the derived key
-	keyslotSize := d.hdr.KeyBytes * stripesNum
-	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
+	if slot.Stripes == 0 {
+		return nil, fmt.Errorf("keyslot[%v] has invalid number of anti-forensic stripes", keyslotIdx)
+	}
+	keyslotSize := afSplitSize(int(d.hdr.KeyBytes), int(slot.Stripes))
+	keyslotOffset := int(slot.KeyMaterialOffset) * storageSectorSize
+	areaEnd, err := d.keyslotAreaEnd(keyslotIdx)
+	if err != nil {
+		return nil, err
+	}
+	if keyslotOffset+keyslotSize > areaEnd {
+		return nil, fmt.Errorf("keyslot[%v] material with %v stripes exceeds the keyslot area", keyslotIdx, slot.Stripes)
 	}
 	keyData := make([]byte, keyslotSize)
 	defer clearSlice(keyData)
 
-	if _, err := d.f.ReadAt(keyData, int64(slot.KeyMaterialOffset)*storageSectorSize); err != nil {
+	if _, err := d.f.ReadAt(keyData, int64(keyslotOffset)); err != nil {
 		return nil, err
 	}
 
-	ciph, err := d.buildLuks1AfCipher(afKey)
+	ciph, err := newSectorCipher(d.hdr.encryption(), afKey)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
+	for i := 0; i < keyslotSize/storageSectorSize; i++ {
 		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
 		ciph.Decrypt(block, block, uint64(i))
 	}
 
 	// anti-forensic merge
-	if slot.Stripes != stripesNum {
-		return nil, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
-	}
 	return afMerge(keyData, int(d.hdr.KeyBytes), int(slot.Stripes), h())
 }
 
-func (d *deviceV1) buildLuks1AfCipher(afKey []byte) (*xts.Cipher, error) {
-	var cipherFunc func(key []byte) (cipher.Block, error)
+// keyslotAreaEnd returns the offset where the keyslot material area ends: at the material of the next keyslot,
+// at the payload or at the end of the header storage, whichever comes first
+func (d *deviceV1) keyslotAreaEnd(keyslotIdx int) (int, error) {
+	end := int(d.hdr.PayloadOffset) * storageSectorSize
+	size, err := readerSize(d.f)
+	if err != nil && end == 0 {
+		return 0, err
+	}
+	if err == nil && (end == 0 || int(size) < end) {
+		end = int(size)
+	}
+
+	offset := d.hdr.KeySlots[keyslotIdx].KeyMaterialOffset
+	for _, s := range d.hdr.KeySlots {
+		if next := int(s.KeyMaterialOffset) * storageSectorSize; s.KeyMaterialOffset > offset && next < end {
+			end = next
+		}
+	}
+	return end, nil
+}
 
-	cipherName := fixedArrayToString(d.hdr.CipherName[:])
-	cipherFunc, err := getCipher(cipherName)
+// writeKeyslot derives a key from the passphrase, encrypts AF-split volume key with it and writes the resulting
+// key material to w. The keyslot is marked as active in the in-memory header, use writeHeader to persist it.
+func (d *deviceV1) writeKeyslot(w io.WriterAt, keyslotIdx int, volumeKey, passphrase []byte, iterations uint) error {
+	slot := &d.hdr.KeySlots[keyslotIdx]
+
+	algo := fixedArrayToString(d.hdr.HashSpec[:])
+	h, _ := getHashAlgo(algo)
+	if h == nil {
+		return fmt.Errorf("Unknown hash spec algorithm: %v", algo)
+	}
+
+	if _, err := rand.Read(slot.Salt[:]); err != nil {
+		return err
+	}
+	slot.Iterations = uint32(iterations)
+
+	afKey := deriveLuks1AfKey(passphrase, *slot, int(d.hdr.KeyBytes), h)
+	defer clearSlice(afKey)
+
+	splitKey, err := afSplit(volumeKey, int(slot.Stripes), h())
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer clearSlice(splitKey)
+
+	keyData := make([]byte, roundUp(len(splitKey), storageSectorSize))
+	defer clearSlice(keyData)
+	copy(keyData, splitKey)
+
+	ciph, err := newSectorCipher(d.hdr.encryption(), afKey)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(keyData)/storageSectorSize; i++ {
+		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
 	}
 
-	cipherMode := fixedArrayToString(d.hdr.CipherMode[:])
-	switch cipherMode {
-	case "xts-plain64":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
+	if _, err := w.WriteAt(keyData, int64(slot.KeyMaterialOffset)*storageSectorSize); err != nil {
+		return err
+	}
+
+	slot.Active = luksV1SlotEnabled
+	return nil
+}
+
+// writeHeader writes the binary header to w
+func (d *deviceV1) writeHeader(w io.WriterAt) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, d.hdr); err != nil {
+		return err
+	}
+	_, err := w.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func (d *deviceV1) BackupHeader(w io.Writer) error {
+	_, err := io.Copy(w, io.NewSectionReader(d.f, 0, d.hdr.headerAreaSize()))
+	return err
+}
+
+// headerAreaSize returns size of the header area that includes the binary header and keyslots material
+func (hdr *headerV1) headerAreaSize() int64 {
+	if hdr.PayloadOffset != 0 {
+		return int64(hdr.PayloadOffset) * storageSectorSize
+	}
+
+	// detached header, the area ends after the last keyslot
+	var end int
+	for _, s := range hdr.KeySlots {
+		slotEnd := int(s.KeyMaterialOffset)*storageSectorSize + afSplitSize(int(hdr.KeyBytes), int(s.Stripes))
+		if slotEnd > end {
+			end = slotEnd
+		}
 	}
+	return int64(roundUp(end, luksV1KeyslotAlignment))
+}
+
+// validate checks that the keyslots material fits into the header area of the given size
+// and the area ends at the payload
+func (hdr *headerV1) validate(size int64) error {
+	if hdr.KeyBytes == 0 {
+		return fmt.Errorf("invalid volume key size 0")
+	}
+	binaryHeaderSize := int64(binary.Size(*hdr))
+	for i, s := range hdr.KeySlots {
+		if s.Active != luksV1SlotEnabled && s.Active != luksV1SlotDisabled {
+			return fmt.Errorf("keyslot %d has invalid state 0x%x", i, s.Active)
+		}
+		if s.Stripes == 0 {
+			return fmt.Errorf("keyslot %d has invalid number of anti-forensic stripes", i)
+		}
+		offset := int64(s.KeyMaterialOffset) * storageSectorSize
+		end := offset + int64(afSplitSize(int(hdr.KeyBytes), int(s.Stripes)))
+		if offset < binaryHeaderSize || end > size {
+			return fmt.Errorf("keyslot %d material [%d, %d) is outside of the header area of size %d", i, offset, end, size)
+		}
+	}
+	if hdr.PayloadOffset != 0 && int64(hdr.PayloadOffset)*storageSectorSize != size {
+		return fmt.Errorf("payload offset %d does not match the header area size %d", int64(hdr.PayloadOffset)*storageSectorSize, size)
+	}
+	return nil
+}
+
+// encryption returns the encryption specification e.g. 'aes-cbc-essiv:sha256'
+func (hdr *headerV1) encryption() string {
+	return fixedArrayToString(hdr.CipherName[:]) + "-" + fixedArrayToString(hdr.CipherMode[:])
 }
 
 var (
@@ -242,6 +551,12 @@ var (
 	luksMetaNullUUID = make([]byte, 16)
 )
 
+const (
+	luksMetaVersion = 1
+	// luksmeta header and payloads are aligned to this value
+	luksMetaAlignment = 4096
+)
+
 type luksMetaSlot struct {
 	UUID   [16]byte
 	Offset uint32
@@ -257,48 +572,108 @@ type luksMetaHeader struct {
 	Slots   [8]luksMetaSlot
 }
 
-// readLuksMeta read non-standard metadata information for LUKS v1
+// readLuksMeta reads non-standard metadata information for LUKS v1
 // It follows implementation defined at https://github.com/latchset/luksmeta
-func (d *deviceV1) Tokens() ([]Token, error) {
+// The returned header is nil if luksmeta is not initialized.
+func (d *deviceV1) readLuksMeta() (*luksMetaHeader, int64, error) {
 	var hdr luksMetaHeader
 	data := make([]byte, unsafe.Sizeof(hdr))
 
+	holeOffset := d.luksMetaOffset()
+	if _, err := d.f.ReadAt(data, holeOffset); err != nil {
+		return nil, 0, err
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &hdr); err != nil {
+		return nil, 0, err
+	}
+
+	if !bytes.Equal(hdr.Magic[:], luksMetaMagic) {
+		return nil, holeOffset, nil
+	}
+
+	crcFieldOffset := unsafe.Offsetof(hdr.Crc32)
+	clearSlice(data[crcFieldOffset : crcFieldOffset+4])
+	hdrChecksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := hdrChecksum.Write(data); err != nil {
+		return nil, 0, err
+	}
+	if hdrChecksum.Sum32() != hdr.Crc32 {
+		return nil, 0, fmt.Errorf("Luks Meta header CRC error")
+	}
+
+	return &hdr, holeOffset, nil
+}
+
+// luksMetaOffset returns offset of the luksmeta header, it is located right after the keyslots material
+func (d *deviceV1) luksMetaOffset() int64 {
 	var holeOffset int
-	length := int(d.hdr.KeyBytes * stripesNum)
 	for _, s := range d.hdr.KeySlots {
 		offset := int(s.KeyMaterialOffset * storageSectorSize)
+		length := afSplitSize(int(d.hdr.KeyBytes), int(s.Stripes))
 		if holeOffset < offset+length {
 			holeOffset = offset + length
 		}
 	}
-	holeOffset = roundUp(holeOffset, 4096)
+	return int64(roundUp(holeOffset, luksMetaAlignment))
+}
 
-	if _, err := d.f.ReadAt(data, int64(holeOffset)); err != nil {
-		return nil, err
-	}
-	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &hdr); err != nil {
-		return nil, err
+// writeLuksMeta updates the header checksum and writes the luksmeta header to w
+func writeLuksMeta(w io.WriterAt, hdr *luksMetaHeader, offset int64) error {
+	hdr.Crc32 = 0
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+		return err
 	}
+	data := buf.Bytes()
+	hdr.Crc32 = crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(data[unsafe.Offsetof(hdr.Crc32):], hdr.Crc32)
 
-	tokens := make([]Token, 0)
-	if !bytes.Equal(hdr.Magic[:], luksMetaMagic) {
-		return tokens, nil
+	_, err := w.WriteAt(data, offset)
+	return err
+}
+
+// allocate finds a free region for a payload of the given size in the luksmeta area, see find_gap() in luksmeta
+func (hdr *luksMetaHeader) allocate(length, areaSize int) (int, error) {
+	offset := roundUp(int(unsafe.Sizeof(*hdr)), luksMetaAlignment)
+	for {
+		end := offset + roundUp(length, luksMetaAlignment)
+		if end > areaSize {
+			return 0, fmt.Errorf("not enough space in the luksmeta area for a payload of size %d", length)
+		}
+
+		overlap := false
+		for _, s := range hdr.Slots {
+			if bytes.Equal(s.UUID[:], luksMetaNullUUID) {
+				continue
+			}
+			slotEnd := int(s.Offset) + roundUp(int(s.Length), luksMetaAlignment)
+			if offset < slotEnd && int(s.Offset) < end {
+				overlap = true
+				offset = slotEnd
+				break
+			}
+		}
+		if !overlap {
+			return offset, nil
+		}
 	}
+}
 
-	crcFieldOffset := unsafe.Offsetof(hdr.Crc32)
-	clearSlice(data[crcFieldOffset : crcFieldOffset+4])
-	hdrChecksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
-	if _, err := hdrChecksum.Write(data); err != nil {
+func (d *deviceV1) Tokens() ([]Token, error) {
+	hdr, holeOffset, err := d.readLuksMeta()
+	if err != nil {
 		return nil, err
 	}
-	if hdrChecksum.Sum32() != hdr.Crc32 {
-		return nil, fmt.Errorf("Luks Meta header CRC error")
+
+	tokens := make([]Token, 0)
+	if hdr == nil {
+		return tokens, nil
 	}
 
 	for i, s := range hdr.Slots {
 		if !bytes.Equal(s.UUID[:], luksMetaNullUUID) {
 			payload := make([]byte, s.Length)
-			if _, err := d.f.ReadAt(payload, int64(holeOffset)+int64(s.Offset)); err != nil {
+			if _, err := d.f.ReadAt(payload, holeOffset+int64(s.Offset)); err != nil {
 				return nil, err
 			}
 			tokenChecksum := crc32.New(crc32.MakeTable(crc32.Castagnoli))
@@ -322,6 +697,110 @@ func (d *deviceV1) Tokens() ([]Token, error) {
 	return tokens, nil
 }
 
+func (d *deviceV1) TokenImport(token Token) (int, error) {
+	if token.Type != "clevis" {
+		return 0, fmt.Errorf("LUKS1 supports only clevis tokens, got %v", token.Type)
+	}
+	if len(token.Slots) != 1 {
+		return 0, fmt.Errorf("LUKS1 token must refer to exactly one keyslot, got %v", token.Slots)
+	}
+	slot := token.Slots[0]
+	if slot < 0 || slot >= len(d.hdr.KeySlots) || d.hdr.KeySlots[slot].Active != luksV1SlotEnabled {
+		return 0, fmt.Errorf("token refers to keyslot %d that does not exist", slot)
+	}
+	if token.ID >= 0 && token.ID != slot {
+		return 0, fmt.Errorf("LUKS1 token id %d must match its keyslot %d", token.ID, slot)
+	}
+	if d.hdr.PayloadOffset == 0 {
+		return 0, fmt.Errorf("luksmeta is not supported for devices with a detached header")
+	}
+
+	hdr, holeOffset, err := d.readLuksMeta()
+	if err != nil {
+		return 0, err
+	}
+	areaSize := int(int64(d.hdr.PayloadOffset)*storageSectorSize - holeOffset)
+	if hdr == nil {
+		// initialize luksmeta, like `luksmeta init` it refuses to overwrite data in the area
+		unused, err := isZeroArea(d.f, holeOffset, int64(areaSize))
+		if err != nil {
+			return 0, err
+		}
+		if !unused {
+			return 0, fmt.Errorf("luksmeta area at offset %d is not empty", holeOffset)
+		}
+		hdr = &luksMetaHeader{Version: luksMetaVersion}
+		copy(hdr.Magic[:], luksMetaMagic)
+	}
+	if !bytes.Equal(hdr.Slots[slot].UUID[:], luksMetaNullUUID) {
+		return 0, fmt.Errorf("token %d is in use", slot)
+	}
+
+	offset, err := hdr.allocate(len(token.Payload), areaSize)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(token.Payload, holeOffset+int64(offset)); err != nil {
+		return 0, err
+	}
+	s := &hdr.Slots[slot]
+	copy(s.UUID[:], clevisUUID)
+	s.Offset = uint32(offset)
+	s.Length = uint32(len(token.Payload))
+	s.Crc32 = crc32.Checksum(token.Payload, crc32.MakeTable(crc32.Castagnoli))
+	if err := writeLuksMeta(f, hdr, holeOffset); err != nil {
+		return 0, err
+	}
+	return slot, f.Sync()
+}
+
+func (d *deviceV1) TokenExport(id int) (Token, error) {
+	tokens, err := d.Tokens()
+	if err != nil {
+		return Token{}, err
+	}
+	for _, t := range tokens {
+		if t.ID == id {
+			return t, nil
+		}
+	}
+	return Token{}, fmt.Errorf("token %d does not exist", id)
+}
+
+func (d *deviceV1) TokenRemove(id int) error {
+	hdr, holeOffset, err := d.readLuksMeta()
+	if err != nil {
+		return err
+	}
+	if hdr == nil || id < 0 || id >= len(hdr.Slots) || bytes.Equal(hdr.Slots[id].UUID[:], luksMetaNullUUID) {
+		return fmt.Errorf("token %d does not exist", id)
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// wipe the payload first, similar to `luksmeta wipe`
+	s := hdr.Slots[id]
+	if _, err := f.WriteAt(make([]byte, s.Length), holeOffset+int64(s.Offset)); err != nil {
+		return err
+	}
+	hdr.Slots[id] = luksMetaSlot{}
+	if err := writeLuksMeta(f, hdr, holeOffset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
 var clevisUUID = []byte{0xcb, 0x6e, 0x89, 0x04, 0x81, 0xff, 0x40, 0xda, 0xa8, 0x4a, 0x07, 0xab, 0x9a, 0xb5, 0x71, 0x5e}
 
 func luksMetaTokenType(uuid []byte) string {
@@ -1,6 +1,9 @@
 package luks
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
@@ -63,6 +66,22 @@ func TestLuks1Sha512(t *testing.T) {
 	runLuks1Test(t, "--hash", "sha512")
 }
 
+func TestLuks1CbcEssiv(t *testing.T) {
+	runLuks1Test(t, "--cipher", "aes-cbc-essiv:sha256", "--key-size", "256")
+}
+
+func TestLuks1CbcPlain(t *testing.T) {
+	runLuks1Test(t, "--cipher", "aes-cbc-plain", "--key-size", "256")
+}
+
+func TestLuks1XtsPlain(t *testing.T) {
+	runLuks1Test(t, "--cipher", "aes-xts-plain")
+}
+
+func TestLuks1Serpent(t *testing.T) {
+	runLuks1Test(t, "--cipher", "serpent-cbc-essiv:sha256", "--key-size", "256")
+}
+
 func TestLuks1UnlockMultipleKeySlots(t *testing.T) {
 	t.Parallel()
 
@@ -152,3 +171,390 @@ func TestReadLuksMetaInitialized(t *testing.T) {
 	_, err = d.UnsealVolume(0, []byte(password))
 	require.NoError(t, err)
 }
+
+func TestLuks1AddKey(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.AddKey([]byte("wrongpassword"), []byte("newpwd"), nil)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &KDFOptions{Type: "argon2id"})
+	require.Error(t, err)
+	// all LUKS1 keyslots use the hash of the header
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &KDFOptions{Hash: "sha512", Iterations: 1000})
+	require.ErrorContains(t, err, "LUKS1 header uses sha256 hash")
+	require.Equal(t, []int{0}, dev.Slots())
+
+	// fill all the remaining slots
+	for i := 1; i < 8; i++ {
+		slot, err := dev.AddKey([]byte(password), []byte(fmt.Sprintf("newpwd%d", i)), &KDFOptions{Iterations: 1000})
+		require.NoError(t, err)
+		require.Equal(t, i, slot)
+	}
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &KDFOptions{Iterations: 1000})
+	require.Error(t, err)
+
+	d, err := initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, d.Slots())
+
+	v0, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	for i := 1; i < 8; i++ {
+		v, err := d.UnsealVolume(i, []byte(fmt.Sprintf("newpwd%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, v0.key, v.key)
+	}
+}
+
+func TestLuks1KillSlot(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.AddKey([]byte(password), []byte("newpwd1"), &testKdf)
+	require.NoError(t, err)
+	_, err = dev.AddKey([]byte(password), []byte("newpwd2"), &testKdf)
+	require.NoError(t, err)
+
+	d := dev.(*deviceV1)
+	slot := d.hdr.KeySlots[1]
+	keyMaterial := make([]byte, d.hdr.KeyBytes*slot.Stripes)
+	_, err = disk.ReadAt(keyMaterial, int64(slot.KeyMaterialOffset)*512)
+	require.NoError(t, err)
+
+	require.NoError(t, dev.KillSlot(1, false))
+	require.Error(t, dev.KillSlot(1, false))
+	require.Equal(t, ErrPassphraseDoesNotMatch, dev.RemoveKey([]byte("newpwd1"), false))
+	require.NoError(t, dev.RemoveKey([]byte("newpwd2"), false))
+
+	// the key material is overwritten
+	wiped := make([]byte, len(keyMaterial))
+	_, err = disk.ReadAt(wiped, int64(slot.KeyMaterialOffset)*512)
+	require.NoError(t, err)
+	require.NotEqual(t, keyMaterial, wiped)
+
+	d, err = initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, uint32(luksV1SlotDisabled), d.hdr.KeySlots[1].Active)
+	_, err = d.UnsealVolume(1, []byte("newpwd1"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	// the last slot is protected
+	require.Equal(t, ErrLastKeyslot, d.KillSlot(0, false))
+	require.Equal(t, ErrLastKeyslot, d.RemoveKey([]byte(password), false))
+	require.NoError(t, d.KillSlot(0, true))
+	require.Empty(t, d.Slots())
+}
+
+func TestLuks1ChangeKey(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	require.Equal(t, ErrPassphraseDoesNotMatch, dev.ChangeKey(0, []byte("wrongpassword"), []byte("newpwd"), nil))
+	require.Error(t, dev.ChangeKey(0, []byte(password), []byte("newpwd"), &KDFOptions{Hash: "sha1"}))
+	require.NoError(t, dev.ChangeKey(0, []byte(password), []byte("newpwd"), nil))
+	require.NoError(t, dev.ChangeKey(0, []byte("newpwd"), []byte("newpwd2"), &KDFOptions{Iterations: 2000}))
+
+	d, err := initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, uint32(2000), d.hdr.KeySlots[0].Iterations)
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	_, err = d.UnsealVolume(0, []byte("newpwd"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	v2, err := d.UnsealVolume(0, []byte("newpwd2"))
+	require.NoError(t, err)
+	require.Equal(t, v.key, v2.key)
+
+	// with all slots occupied the key material is changed in-place
+	for i := 1; i < 8; i++ {
+		_, err := d.AddKey([]byte("newpwd2"), []byte(fmt.Sprintf("newpwd%d", i+10)), &testKdf)
+		require.NoError(t, err)
+	}
+	require.NoError(t, d.ChangeKey(3, []byte("newpwd13"), []byte("newpwd3"), nil))
+
+	d, err = initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+	v3, err := d.UnsealVolume(3, []byte("newpwd3"))
+	require.NoError(t, err)
+	require.Equal(t, v.key, v3.key)
+	_, err = d.UnsealVolume(4, []byte("newpwd14"))
+	require.NoError(t, err)
+}
+
+func TestLuks1DetachedHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	header := prepareEmptyDisk(t, 2*1024*1024)
+	dev, err := Format(header.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	data := prepareEmptyDisk(t, 4*1024*1024)
+
+	d, err := OpenWithHeader(header.Name(), data.Name())
+	require.NoError(t, err)
+	defer d.Close()
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, data.Name(), v.BackingDevice)
+	require.Equal(t, uint64(2*1024*1024), v.StorageSize)
+}
+
+func TestLuks1BackupRestoreHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	var backup bytes.Buffer
+	require.NoError(t, dev.BackupHeader(&backup))
+	require.Equal(t, 2*1024*1024, backup.Len())
+
+	// destroy the header and then restore it
+	_, err = disk.WriteAt(make([]byte, 2*1024*1024), 0)
+	require.NoError(t, err)
+	_, err = Open(disk.Name())
+	require.Error(t, err)
+
+	// a device without a valid LUKS header is overwritten only if it is forced
+	require.ErrorContains(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()), false), "use force")
+	require.NoError(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()), true))
+	d, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, 1, d.Version())
+	require.Equal(t, dev.UUID(), d.UUID())
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	// the backup does not belong to another device
+	other := prepareEmptyDisk(t, 4*1024*1024)
+	otherDev, err := Format(other.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer otherDev.Close()
+	require.Error(t, RestoreHeader(other.Name(), bytes.NewReader(backup.Bytes()), true))
+
+	// truncated backup
+	require.Error(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()[:4096]), true))
+
+	// keyslot material and payload offset must match the backup size
+	hdr := *d.(*deviceV1).hdr
+	hdr.KeySlots[7].Stripes = 100000
+	invalid := bytes.NewBuffer(nil)
+	require.NoError(t, binary.Write(invalid, binary.BigEndian, &hdr))
+	invalid.Write(backup.Bytes()[invalid.Len():])
+	require.ErrorContains(t, RestoreHeader(disk.Name(), invalid, true), "keyslot 7 material")
+
+	hdr = *d.(*deviceV1).hdr
+	hdr.PayloadOffset *= 2
+	invalid.Reset()
+	require.NoError(t, binary.Write(invalid, binary.BigEndian, &hdr))
+	invalid.Write(backup.Bytes()[invalid.Len():])
+	require.ErrorContains(t, RestoreHeader(disk.Name(), invalid, true), "payload offset")
+}
+
+func TestLuks1OpenReaderAt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	image, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+
+	d, err := OpenReaderAt(bytes.NewReader(image), int64(len(image)))
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, 1, d.Version())
+	require.Equal(t, dev.UUID(), d.UUID())
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, "", v.BackingDevice)
+	require.Equal(t, uint64(2*1024*1024), v.StorageSize)
+
+	require.Error(t, d.KillSlot(0, true))
+}
+
+func TestLuks1NonStandardStripes(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	d := dev.(*deviceV1)
+
+	for i, stripes := range []uint32{1, 3, 1000} {
+		slot := i + 1
+		d.hdr.KeySlots[slot].Stripes = stripes
+		require.NoError(t, d.writeKeyslot(disk, slot, v.key, []byte(fmt.Sprintf("password%d", slot)), 1000))
+	}
+	require.NoError(t, d.writeHeader(disk))
+	require.NoError(t, dev.Close())
+
+	d2, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer d2.Close()
+	require.Equal(t, []int{0, 1, 2, 3}, d2.Slots())
+	for slot := 1; slot <= 3; slot++ {
+		v2, err := d2.UnsealVolume(slot, []byte(fmt.Sprintf("password%d", slot)))
+		require.NoError(t, err)
+		require.Equal(t, v.key, v2.key)
+	}
+
+	tokens, err := d2.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	// the stripes overlap with the next keyslot
+	hdr := d2.(*deviceV1).hdr
+	hdr.KeySlots[1].Stripes = 100000
+	_, err = d2.UnsealVolume(1, []byte("password1"))
+	require.ErrorContains(t, err, "exceeds the keyslot area")
+
+	// the material of the last keyslot of a detached header is limited by the header size
+	hdr.PayloadOffset = 0
+	hdr.KeySlots[3].KeyMaterialOffset = 2 * 1024 * 1024 / storageSectorSize
+	hdr.KeySlots[3].Stripes = 0xffffffff
+	_, err = d2.UnsealVolume(3, []byte("password3"))
+	require.ErrorContains(t, err, "exceeds the keyslot area")
+}
+
+func TestLuks1Tokens(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	id, err := dev.TokenImport(Token{ID: -1, Slots: []int{1}, Type: "clevis", Payload: []byte("testdata1")})
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+	id, err = dev.TokenImport(Token{ID: 0, Slots: []int{0}, Type: "clevis", Payload: bytes.Repeat([]byte("a"), 5000)})
+	require.NoError(t, err)
+	require.Equal(t, 0, id)
+
+	for _, token := range []Token{
+		{ID: -1, Slots: []int{1}, Type: "clevis"},        // the token is in use
+		{ID: -1, Slots: []int{2}, Type: "clevis"},        // the keyslot is inactive
+		{ID: -1, Slots: []int{0, 1}, Type: "clevis"},     // too many keyslots
+		{ID: 3, Slots: []int{1}, Type: "clevis"},         // the id does not match the keyslot
+		{ID: -1, Slots: []int{1}, Type: "systemd-fido2"}, // unsupported type
+	} {
+		_, err := dev.TokenImport(token)
+		require.Error(t, err, "%+v", token)
+	}
+
+	d, err := initV1Device(disk.Name(), disk)
+	require.NoError(t, err)
+	token, err := d.TokenExport(1)
+	require.NoError(t, err)
+	require.Equal(t, Token{ID: 1, Slots: []int{1}, Type: "clevis", Payload: []byte("testdata1")}, token)
+	_, err = d.TokenExport(2)
+	require.Error(t, err)
+
+	// the space of the removed token is reused
+	require.NoError(t, d.TokenRemove(1))
+	require.Error(t, d.TokenRemove(1))
+	_, err = d.TokenImport(Token{ID: -1, Slots: []int{1}, Type: "clevis", Payload: []byte("testdata2")})
+	require.NoError(t, err)
+	meta, _, err := d.readLuksMeta()
+	require.NoError(t, err)
+	require.Equal(t, uint32(4096), meta.Slots[1].Offset)
+	require.Equal(t, uint32(8192), meta.Slots[0].Offset)
+
+	tokens, err = d.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, bytes.Repeat([]byte("a"), 5000), tokens[0].Payload)
+	require.Equal(t, "testdata2", string(tokens[1].Payload))
+}
+
+func TestLuks1TokenImportUsedArea(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// data in the gap after the keyslots, luksmeta must not be initialized over it
+	offset := dev.(*deviceV1).luksMetaOffset() + 3*4096
+	_, err = disk.WriteAt([]byte("foreign data"), offset)
+	require.NoError(t, err)
+
+	_, err = dev.TokenImport(Token{ID: -1, Slots: []int{0}, Type: "clevis", Payload: []byte("testdata")})
+	require.Error(t, err)
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+	data := make([]byte, len("foreign data"))
+	_, err = disk.ReadAt(data, offset)
+	require.NoError(t, err)
+	require.Equal(t, "foreign data", string(data))
+}
+
+func TestLuks1TokenImportLuksMeta(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.TokenImport(Token{ID: -1, Slots: []int{0}, Type: "clevis", Payload: []byte("testdata")})
+	require.NoError(t, err)
+
+	out, err := exec.Command("luksmeta", "load", "-d", disk.Name(), "-s", "0").Output()
+	require.NoError(t, err)
+	require.Equal(t, "testdata", string(out))
+}
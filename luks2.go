@@ -2,21 +2,20 @@ package luks
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"crypto/sha512"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"hash"
-	"os"
+	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"unsafe"
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
-	"golang.org/x/crypto/xts"
 )
 
 // LUKS v2 format is specified here
@@ -38,85 +37,131 @@ type headerV2 struct {
 }
 
 type deviceV2 struct {
-	path  string
-	f     *os.File
+	path  string      // empty if the device is opened with OpenReaderAt
+	f     io.ReaderAt // header storage
 	hdr   *headerV2
 	meta  *metadata
 	flags []string
+	// data storage, it differs from the header storage if a detached header is used
+	dataPath string
+	data     io.ReaderAt
 }
 
-func initV2Device(path string, f *os.File) (*deviceV2, error) {
-	var hdr headerV2
+// offsets where the secondary header copy is looked for if the primary header is damaged, see hdr2_offsets[]
+var luks2SecondaryHeaderOffsets = []uint64{0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
 
-	if _, err := f.Seek(0, 0); err != nil {
+func initV2Device(path string, f io.ReaderAt) (*deviceV2, error) {
+	hdr, meta, err := readHeadersV2(f)
+	if err != nil {
 		return nil, err
 	}
-	if err := binary.Read(f, binary.BigEndian, &hdr); err != nil {
-		return nil, err
+
+	return &deviceV2{
+		path:     path,
+		f:        f,
+		hdr:      hdr,
+		meta:     meta,
+		flags:    meta.Config.Flags,
+		dataPath: path,
+		data:     f,
+	}, nil
+}
+
+// readHeadersV2 reads and validates both header copies and returns the one with the most recent metadata
+func readHeadersV2(f io.ReaderAt) (*headerV2, *metadata, error) {
+	hdr, meta, err := readHeaderV2(f, 0, luks2MagicPrimary)
+
+	// the secondary header follows the primary one, if the primary header is damaged then probe the well-known offsets
+	secondaryOffsets := luks2SecondaryHeaderOffsets
+	if err == nil {
+		secondaryOffsets = []uint64{hdr.HeaderSize}
+	}
+	var hdr2 *headerV2
+	var meta2 *metadata
+	var err2 error
+	for _, offset := range secondaryOffsets {
+		hdr2, meta2, err2 = readHeaderV2(f, offset, luks2MagicSecondary)
+		if err2 == nil {
+			break
+		}
+	}
+
+	if err != nil && err2 != nil {
+		return nil, nil, err
+	}
+	// use the copy with the most recent metadata
+	if err != nil || (err2 == nil && hdr2.SequenceID > hdr.SequenceID) {
+		hdr, meta = hdr2, meta2
+	}
+	return hdr, meta, nil
+}
+
+// readHeaderV2 reads a header copy located at the given offset and validates it
+func readHeaderV2(f io.ReaderAt, offset uint64, magic []byte) (*headerV2, *metadata, error) {
+	var hdr headerV2
+
+	if err := binary.Read(io.NewSectionReader(f, int64(offset), int64(binary.Size(hdr))), binary.BigEndian, &hdr); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr.Magic[:], magic) || hdr.Version != 2 {
+		return nil, nil, fmt.Errorf("invalid LUKS header at offset %v", offset)
+	}
+	if hdr.HeaderOffset != offset {
+		return nil, nil, fmt.Errorf("LUKS header at offset %v has mismatched header offset %v", offset, hdr.HeaderOffset)
 	}
 
 	hdrSize := hdr.HeaderSize // size of header + JSON metadata
 	if !isPowerOfTwo(uint(hdrSize)) || hdrSize < 16384 || hdrSize > 4194304 {
-		return nil, fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
+		return nil, nil, fmt.Errorf("Invalid size of LUKS header: %v", hdrSize)
 	}
 
 	// read the whole header
 	data := make([]byte, hdrSize)
-	if _, err := f.ReadAt(data, 0); err != nil {
-		return nil, err
-	}
-
-	for i := 0; i < 64; i++ {
-		// clear the checksum
-		data[int(unsafe.Offsetof(hdr.Checksum))+i] = 0
+	if _, err := f.ReadAt(data, int64(offset)); err != nil {
+		return nil, nil, err
 	}
 
-	// calculate the checksum of the whole header
-	var h hash.Hash
-	algo := fixedArrayToString(hdr.ChecksumAlgorithm[:])
-	switch algo {
-	case "sha256":
-		h = sha256.New()
-	default:
-		return nil, fmt.Errorf("Unknown header checksum algorithm: %v", algo)
+	checksum, err := headerV2Checksum(fixedArrayToString(hdr.ChecksumAlgorithm[:]), data)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	h.Write(data)
-
-	checksum := h.Sum(make([]byte, 0))
-	expectedChecksum := hdr.Checksum[:h.Size()]
+	expectedChecksum := hdr.Checksum[:len(checksum)]
 	if !bytes.Equal(checksum, expectedChecksum) {
-		return nil, fmt.Errorf("Invalid header checksum")
+		return nil, nil, fmt.Errorf("Invalid header checksum")
 	}
 
 	var meta metadata
-	jsonData := data[4096:]
-	jsonData = jsonData[:bytes.IndexByte(jsonData, 0)]
+	jsonData := data[luks2BinaryHeaderSize:]
+	if idx := bytes.IndexByte(jsonData, 0); idx != -1 {
+		jsonData = jsonData[:idx]
+	}
 
 	if err := json.Unmarshal(jsonData, &meta); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return &deviceV2{
-		path:  path,
-		f:     f,
-		hdr:   &hdr,
-		meta:  &meta,
-		flags: meta.Config.Flags,
-	}, nil
+	return &hdr, &meta, nil
 }
 
 func (d *deviceV2) Close() error {
-	return d.f.Close()
+	return closeStorage(d.path, d.f, d.data)
 }
 
 func (d *deviceV2) Path() string {
 	return d.path
 }
 
+func (d *deviceV2) HeaderOffset() uint64 {
+	return d.hdr.HeaderOffset
+}
+
 func (d *deviceV2) Slots() []int {
 	var normPrio, highPrio []int
 	for i, k := range d.meta.Keyslots {
+		if k.Type != "luks2" {
+			// e.g. reencrypt keyslot does not store a volume key
+			continue
+		}
 		if k.Priority != nil && *k.Priority == 2 {
 			highPrio = append(highPrio, i)
 		} else if k.Priority == nil || *k.Priority == 1 {
@@ -130,37 +175,174 @@ func (d *deviceV2) Slots() []int {
 func (d *deviceV2) Tokens() ([]Token, error) {
 	var tokens []Token
 
+	for i, t := range d.meta.Tokens {
+		token, err := parseTokenV2(i, t)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// parseTokenV2 parses common fields of the token JSON, the whole JSON becomes the token payload
+func parseTokenV2(id int, data json.RawMessage) (Token, error) {
 	type tokenNode struct {
 		Type     string
 		Keyslots []json.Number
 	}
 
-	for i, t := range d.meta.Tokens {
-		var node tokenNode
-		if err := json.Unmarshal(t, &node); err != nil {
-			return nil, err
+	var node tokenNode
+	if err := json.Unmarshal(data, &node); err != nil {
+		return Token{}, err
+	}
+
+	keyslots := make([]int, len(node.Keyslots))
+	for j, s := range node.Keyslots {
+		slotID, err := s.Int64()
+		if err != nil {
+			return Token{}, err
+		}
+		keyslots[j] = int(slotID)
+	}
+
+	return Token{
+		ID:      id,
+		Slots:   keyslots,
+		Type:    node.Type,
+		Payload: data,
+	}, nil
+}
+
+const luks2TokensMax = 32
+
+func (d *deviceV2) TokenImport(token Token) (int, error) {
+	if err := d.checkRequirements(); err != nil {
+		return 0, err
+	}
+	if token.Type == "" {
+		return 0, fmt.Errorf("token type is not specified")
+	}
+	for _, s := range token.Slots {
+		if ks, ok := d.meta.Keyslots[s]; !ok || ks.Type != "luks2" {
+			return 0, fmt.Errorf("token refers to keyslot %d that does not exist", s)
 		}
+	}
 
-		keyslots := make([]int, len(node.Keyslots))
-		for j, s := range node.Keyslots {
-			slotID, err := s.Int64()
-			if err != nil {
-				return nil, err
-			}
-			keyslots[j] = int(slotID)
+	id := token.ID
+	if id < 0 {
+		var err error
+		if id, err = d.freeToken(); err != nil {
+			return 0, err
 		}
+	} else if id >= luks2TokensMax {
+		return 0, fmt.Errorf("token id %d is out of range of available tokens", id)
+	} else if _, ok := d.meta.Tokens[id]; ok {
+		return 0, fmt.Errorf("token %d is in use", id)
+	}
 
-		token := Token{
-			ID:      i,
-			Slots:   keyslots,
-			Type:    node.Type,
-			Payload: t,
+	// type and keyslots fields of the payload are replaced with the token fields
+	var fields map[string]json.RawMessage
+	if len(token.Payload) != 0 {
+		if err := json.Unmarshal(token.Payload, &fields); err != nil {
+			return 0, fmt.Errorf("token payload is not a JSON object: %v", err)
 		}
+	}
+	if fields == nil {
+		fields = map[string]json.RawMessage{}
+	}
+	typ, err := json.Marshal(token.Type)
+	if err != nil {
+		return 0, err
+	}
+	fields["type"] = typ
+	keyslots, err := json.Marshal(toQuotedNumbers(token.Slots))
+	if err != nil {
+		return 0, err
+	}
+	fields["keyslots"] = keyslots
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return 0, err
+	}
 
-		tokens = append(tokens, token)
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return 0, err
 	}
+	defer f.Close()
 
-	return tokens, nil
+	if d.meta.Tokens == nil {
+		d.meta.Tokens = map[int]json.RawMessage{}
+	}
+	d.meta.Tokens[id] = data
+	if err := d.writeHeaders(f); err != nil {
+		delete(d.meta.Tokens, id)
+		return 0, err
+	}
+	return id, f.Sync()
+}
+
+// freeToken returns the lowest unused token id
+func (d *deviceV2) freeToken() (int, error) {
+	for i := 0; i < luks2TokensMax; i++ {
+		if _, ok := d.meta.Tokens[i]; !ok {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no free tokens available")
+}
+
+func (d *deviceV2) TokenExport(id int) (Token, error) {
+	t, ok := d.meta.Tokens[id]
+	if !ok {
+		return Token{}, fmt.Errorf("token %d does not exist", id)
+	}
+	return parseTokenV2(id, t)
+}
+
+func (d *deviceV2) TokenRemove(id int) error {
+	if err := d.checkRequirements(); err != nil {
+		return err
+	}
+	t, ok := d.meta.Tokens[id]
+	if !ok {
+		return fmt.Errorf("token %d does not exist", id)
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	delete(d.meta.Tokens, id)
+	if err := d.writeHeaders(f); err != nil {
+		d.meta.Tokens[id] = t
+		return err
+	}
+	return f.Sync()
+}
+
+func (d *deviceV2) Requirements() []string {
+	if d.meta.Config.Requirements == nil {
+		return nil
+	}
+	return d.meta.Config.Requirements.Mandatory
+}
+
+// supportedRequirements lists LUKS2 mandatory requirements implemented by this library
+var supportedRequirements = map[string]bool{}
+
+// checkRequirements returns UnsupportedRequirementError if the device has a requirement unknown to this library
+func (d *deviceV2) checkRequirements() error {
+	for _, r := range d.Requirements() {
+		if !supportedRequirements[r] {
+			return &UnsupportedRequirementError{Requirement: r}
+		}
+	}
+	return nil
 }
 
 func (d *deviceV2) UUID() string {
@@ -208,103 +390,482 @@ func (d *deviceV2) UnlockAny(passphrase []byte, dmName string) error {
 	return ErrPassphraseDoesNotMatch
 }
 
-func (d *deviceV2) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
-	keyslots := d.meta.Keyslots
+func (d *deviceV2) UnlockWithTokens(ctx context.Context, dmName string) error {
+	return unlockWithTokens(ctx, d, dmName)
+}
+
+// maximum number of LUKS2 keyslots, see LUKS2_KEYSLOTS_MAX
+const luks2KeyslotsMax = 32
+
+func (d *deviceV2) AddKey(existingPassphrase, newPassphrase []byte, opts *KDFOptions) (int, error) {
+	var o KDFOptions
+	if opts != nil {
+		o = *opts
+	}
+	o = o.withDefaults()
+
+	newSlot, err := d.freeKeyslot()
+	if err != nil {
+		return 0, err
+	}
 
-	keyslot, ok := keyslots[keyslotIdx]
+	volume, existingSlot, err := unsealAny(d, existingPassphrase)
+	if err != nil {
+		return 0, err
+	}
+	defer clearSlice(volume.key)
+
+	// the new keyslot uses the same area encryption as the existing one
+	encryption := d.meta.Keyslots[existingSlot].Area.Encryption
+	areaSize := roundUp(len(volume.key)*stripesNum, luks2KeyslotAlignment)
+	areaOffset, err := d.allocateKeyslotArea(uint64(areaSize))
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := openForWriting(d.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ks, err := createLuks2Keyslot(f, newSlot, volume.key, newPassphrase, encryption, areaOffset, o)
+	if err != nil {
+		return 0, err
+	}
+
+	// keep the digests that are modified, the metadata is restored if it is not written
+	digests := map[int]digest{}
+	for id, dig := range d.meta.Digests {
+		if !dig.hasKeyslot(existingSlot) {
+			continue
+		}
+		digests[id] = dig
+		dig.Keyslots = append(dig.Keyslots, jsonNumber(uint64(newSlot)))
+		d.meta.Digests[id] = dig
+	}
+	d.meta.Keyslots[newSlot] = *ks
+
+	if err := d.writeHeaders(f); err != nil {
+		delete(d.meta.Keyslots, newSlot)
+		for id, dig := range digests {
+			d.meta.Digests[id] = dig
+		}
+		return 0, err
+	}
+	return newSlot, f.Sync()
+}
+
+// freeKeyslot returns the lowest unused keyslot id
+func (d *deviceV2) freeKeyslot() (int, error) {
+	for i := 0; i < luks2KeyslotsMax; i++ {
+		if _, ok := d.meta.Keyslots[i]; !ok {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("no free keyslots available")
+}
+
+func (d *deviceV2) KillSlot(keyslotIdx int, force bool) error {
+	if err := d.checkRequirements(); err != nil {
+		return err
+	}
+
+	ks, ok := d.meta.Keyslots[keyslotIdx]
 	if !ok {
-		return nil, fmt.Errorf("Unable to get a keyslot with id: %d", keyslotIdx)
+		return fmt.Errorf("Unable to get a keyslot with id: %d", keyslotIdx)
+	}
+	if !force && ks.Type == "luks2" {
+		last := true
+		for id, k := range d.meta.Keyslots {
+			if id != keyslotIdx && k.Type == "luks2" {
+				last = false
+				break
+			}
+		}
+		if last {
+			return ErrLastKeyslot
+		}
 	}
 
-	afKey, err := deriveLuks2AfKey(keyslot.Kdf, keyslotIdx, passphrase, keyslot.Area.KeySize)
+	offset, err := ks.Area.Offset.Int64()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("Invalid keyslotIdx[%v] offset: %v. %v", keyslotIdx, ks.Area.Offset, err)
+	}
+	size, err := ks.Area.Size.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", keyslotIdx, ks.Area.Size, err)
 	}
-	defer clearSlice(afKey)
 
-	finalKey, err := d.decryptLuks2VolumeKey(keyslotIdx, keyslot, afKey)
+	f, err := openForWriting(d.path)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer f.Close()
 
-	// verify with digest
-	digest := d.findDigestForKeyslot(keyslotIdx)
-	if digest == nil {
-		return nil, fmt.Errorf("No digest is found for keyslot %v", keyslotIdx)
+	// wipe the key material first, similar to LUKS2_keyslot_wipe()
+	if err := wipeArea(f, offset, size); err != nil {
+		return err
 	}
 
-	generatedDigest, err := computeDigestForKey(digest, keyslotIdx, finalKey)
+	delete(d.meta.Keyslots, keyslotIdx)
+	for id, dig := range d.meta.Digests {
+		dig.Keyslots = dig.Keyslots.without(keyslotIdx)
+		d.meta.Digests[id] = dig
+	}
+	for id, t := range d.meta.Tokens {
+		token, err := removeTokenKeyslot(t, keyslotIdx)
+		if err != nil {
+			return err
+		}
+		d.meta.Tokens[id] = token
+	}
+
+	if err := d.writeHeaders(f); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (d *deviceV2) ChangeKey(keyslotIdx int, oldPassphrase, newPassphrase []byte, opts *KDFOptions) error {
+	volume, err := d.UnsealVolume(keyslotIdx, oldPassphrase)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer clearSlice(generatedDigest)
+	defer clearSlice(volume.key)
 
-	expectedDigest, err := base64.StdEncoding.DecodeString(digest.Digest)
+	ks := d.meta.Keyslots[keyslotIdx]
+	var o KDFOptions
+	if opts != nil {
+		o = *opts
+	} else {
+		o = kdfOptionsFromKeyslot(ks)
+	}
+	o = o.withDefaults()
+
+	oldOffset, err := ks.Area.Offset.Int64()
 	if err != nil {
-		return nil, fmt.Errorf("keyslotIdx[%v].digest.Digest base64 parsing failed: %v", keyslotIdx, err)
+		return fmt.Errorf("Invalid keyslotIdx[%v] offset: %v. %v", keyslotIdx, ks.Area.Offset, err)
 	}
-	if !bytes.Equal(generatedDigest[0:len(expectedDigest)], expectedDigest) {
-		return nil, ErrPassphraseDoesNotMatch
+	oldSize, err := ks.Area.Size.Int64()
+	if err != nil {
+		return fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", keyslotIdx, ks.Area.Size, err)
 	}
-	clearSlice(generatedDigest)
 
-	if len(digest.Segments) != 1 {
-		return nil, fmt.Errorf("LUKS partition expects exactly 1 storage segment, got %+v", len(digest.Segments))
+	// Write the new key material to a free area if possible. This way the old passphrase stays valid
+	// until the header is updated. Otherwise the key material is overwritten in-place.
+	areaSize := roundUp(len(volume.key)*stripesNum, luks2KeyslotAlignment)
+	newOffset, err := d.allocateKeyslotArea(uint64(areaSize))
+	inPlace := err != nil
+	if inPlace {
+		if int64(areaSize) > oldSize {
+			return err
+		}
+		newOffset = uint64(oldOffset)
 	}
-	seg, err := digest.Segments[0].Int64()
+
+	f, err := openForWriting(d.path)
 	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	newKs, err := createLuks2Keyslot(f, keyslotIdx, volume.key, newPassphrase, ks.Area.Encryption, newOffset, o)
+	if err != nil {
+		return err
+	}
+	newKs.Priority = ks.Priority
+	d.meta.Keyslots[keyslotIdx] = *newKs
+
+	if err := d.writeHeaders(f); err != nil {
+		d.meta.Keyslots[keyslotIdx] = ks
+		return err
+	}
+	if !inPlace {
+		if err := wipeArea(f, oldOffset, oldSize); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// kdfOptionsFromKeyslot returns KDF parameters currently used by the keyslot
+func kdfOptionsFromKeyslot(ks keyslot) KDFOptions {
+	o := KDFOptions{
+		Type:       ks.Kdf.Type,
+		Hash:       ks.Af.Hash,
+		Iterations: ks.Kdf.Iterations,
+		Time:       ks.Kdf.Time,
+		Memory:     ks.Kdf.Memory,
+		Threads:    ks.Kdf.Cpus,
+	}
+	if ks.Kdf.Hash != "" {
+		o.Hash = ks.Kdf.Hash
+	}
+	return o
+}
+
+func (d *deviceV2) RemoveKey(passphrase []byte, force bool) error {
+	volume, slot, err := unsealAny(d, passphrase)
+	if err != nil {
+		return err
+	}
+	clearSlice(volume.key)
+
+	return d.KillSlot(slot, force)
+}
+
+// removeTokenKeyslot unassigns the keyslot from the token
+func removeTokenKeyslot(token json.RawMessage, keyslotIdx int) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(token, &fields); err != nil {
 		return nil, err
 	}
+	var keyslots quotedNumbers
+	if err := json.Unmarshal(fields["keyslots"], &keyslots); err != nil {
+		return nil, err
+	}
+
+	filtered := keyslots.without(keyslotIdx)
+	if len(filtered) == len(keyslots) {
+		// keep the token as-is
+		return token, nil
+	}
 
-	storageSegment := d.meta.Segments[int(seg)]
-	offset, err := storageSegment.Offset.Int64()
+	data, err := json.Marshal(filtered)
 	if err != nil {
 		return nil, err
 	}
+	fields["keyslots"] = data
+	return json.Marshal(fields)
+}
+
+func (d *deviceV2) BackupHeader(w io.Writer) error {
+	size, err := headerAreaSizeV2(d.hdr, d.meta)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(d.f, 0, size))
+	return err
+}
+
+// headerAreaSizeV2 returns size of both header copies plus the keyslots area
+func headerAreaSizeV2(hdr *headerV2, meta *metadata) (int64, error) {
+	keyslotsSize, err := meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return 0, err
+	}
+	return 2*int64(hdr.HeaderSize) + keyslotsSize, nil
+}
 
-	var storageSize uint64
-	if storageSegment.Size == "dynamic" {
-		storageSize, err = fileSize(d.f)
+// allocateKeyslotArea finds a free region of the given size in the keyslots area and returns its offset
+func (d *deviceV2) allocateKeyslotArea(size uint64) (uint64, error) {
+	type region struct{ offset, size uint64 }
+	var used []region
+	for id, k := range d.meta.Keyslots {
+		offset, err := k.Area.Offset.Int64()
 		if err != nil {
-			return nil, err
+			return 0, fmt.Errorf("Invalid keyslotIdx[%v] offset: %v. %v", id, k.Area.Offset, err)
 		}
-		if storageSize < uint64(offset) {
-			return nil, fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", storageSize, offset)
+		areaSize, err := k.Area.Size.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("Invalid keyslotIdx[%v] size value: %v. %v", id, k.Area.Size, err)
 		}
+		used = append(used, region{uint64(offset), uint64(areaSize)})
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].offset < used[j].offset })
 
-		storageSize -= uint64(offset)
-	} else {
-		size, err := strconv.Atoi(storageSegment.Size)
-		if err != nil {
-			return nil, err
+	keyslotsSize, err := d.meta.Config.KeyslotsSize.Int64()
+	if err != nil {
+		return 0, err
+	}
+	// keyslots area is located right after the primary and secondary header copies
+	start := 2 * d.hdr.HeaderSize
+	end := start + uint64(keyslotsSize)
+
+	offset := start
+	for _, r := range used {
+		if offset+size <= r.offset {
+			break
 		}
-		if size == 0 {
-			return nil, fmt.Errorf("invalid segment size: %v", size)
+		if r.offset+r.size > offset {
+			offset = r.offset + r.size
 		}
+	}
+	if offset+size > end {
+		return 0, fmt.Errorf("not enough space in the keyslots area for a new keyslot of size %d", size)
+	}
+	return offset, nil
+}
+
+// writeHeaders bumps the header sequence id and writes both copies of the header to w
+func (d *deviceV2) writeHeaders(w io.WriterAt) error {
+	d.hdr.SequenceID++
+	return writeV2Headers(w, d.hdr, d.meta)
+}
 
-		storageSize = uint64(size)
+func (d *deviceV2) UnsealVolume(keyslotIdx int, passphrase []byte) (*Volume, error) {
+	if err := d.checkRequirements(); err != nil {
+		return nil, err
 	}
 
-	ivTweak, err := storageSegment.IvTweak.Int64()
+	finalKey, digest, err := d.unsealKey(keyslotIdx, passphrase)
 	if err != nil {
 		return nil, err
 	}
 
+	segments, err := d.volumeSegments(digest)
+	if err != nil {
+		clearSlice(finalKey)
+		return nil, err
+	}
+	first := segments[0]
+
 	v := &Volume{
-		BackingDevice:     d.path,
+		BackingDevice:     d.dataPath,
 		Flags:             d.flags,
 		UUID:              d.UUID(),
 		key:               finalKey,
 		LuksType:          "LUKS2",
-		StorageSize:       storageSize,
-		StorageOffset:     uint64(offset),
-		StorageEncryption: storageSegment.Encryption,
-		StorageIvTweak:    uint64(ivTweak),
-		StorageSectorSize: uint64(storageSegment.SectorSize),
+		StorageSize:       first.Size,
+		StorageOffset:     first.Offset,
+		StorageEncryption: first.Encryption,
+		StorageIvTweak:    first.IvTweak,
+		StorageSectorSize: first.SectorSize,
+		backing:           d.data,
+	}
+	if len(segments) > 1 {
+		v.Segments = segments
 	}
 	return v, nil
 }
 
+// unsealKey recovers the volume key stored in the keyslot and verifies it with the keyslot digest
+func (d *deviceV2) unsealKey(keyslotIdx int, passphrase []byte) ([]byte, *digest, error) {
+	keyslot, ok := d.meta.Keyslots[keyslotIdx]
+	if !ok {
+		return nil, nil, fmt.Errorf("Unable to get a keyslot with id: %d", keyslotIdx)
+	}
+	if keyslot.Type != "luks2" || keyslot.Kdf == nil || keyslot.Af == nil {
+		return nil, nil, fmt.Errorf("keyslot %d of type %v does not store a volume key", keyslotIdx, keyslot.Type)
+	}
+
+	afKey, err := deriveLuks2AfKey(keyslot.Kdf, keyslotIdx, passphrase, keyslot.Area.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clearSlice(afKey)
+
+	finalKey, err := d.decryptLuks2VolumeKey(keyslotIdx, keyslot, afKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// verify with digest
+	digest := d.findDigestForKeyslot(keyslotIdx)
+	if digest == nil {
+		clearSlice(finalKey)
+		return nil, nil, fmt.Errorf("No digest is found for keyslot %v", keyslotIdx)
+	}
+
+	generatedDigest, err := computeDigestForKey(digest, keyslotIdx, finalKey)
+	if err != nil {
+		clearSlice(finalKey)
+		return nil, nil, err
+	}
+	defer clearSlice(generatedDigest)
+
+	expectedDigest, err := base64.StdEncoding.DecodeString(digest.Digest)
+	if err != nil {
+		clearSlice(finalKey)
+		return nil, nil, fmt.Errorf("keyslotIdx[%v].digest.Digest base64 parsing failed: %v", keyslotIdx, err)
+	}
+	if !bytes.Equal(generatedDigest[0:len(expectedDigest)], expectedDigest) {
+		clearSlice(finalKey)
+		return nil, nil, ErrPassphraseDoesNotMatch
+	}
+	return finalKey, digest, nil
+}
+
+// volumeSegments returns data segments of the volume ordered by segment id. Backup segments (used to track
+// reencryption) are skipped. All crypt segments must be encrypted with the volume key verified by the digest.
+func (d *deviceV2) volumeSegments(dig *digest) ([]VolumeSegment, error) {
+	ids := make([]int, 0, len(d.meta.Segments))
+	for id, seg := range d.meta.Segments {
+		if !seg.isBackup() {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("LUKS partition does not have data segments")
+	}
+	sort.Ints(ids)
+
+	segments := make([]VolumeSegment, 0, len(ids))
+	for i, id := range ids {
+		seg := d.meta.Segments[id]
+		offset, err := seg.Offset.Int64()
+		if err != nil {
+			return nil, err
+		}
+
+		var size uint64
+		if seg.Size == "dynamic" {
+			if i != len(ids)-1 {
+				return nil, fmt.Errorf("only the last segment can have dynamic size, segment %d", id)
+			}
+			size, err = readerSize(d.data)
+			if err != nil {
+				return nil, err
+			}
+			if size < uint64(offset) {
+				return nil, fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", size, offset)
+			}
+			size -= uint64(offset)
+		} else {
+			size, err = strconv.ParseUint(seg.Size, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			if size == 0 {
+				return nil, fmt.Errorf("invalid segment size: %v", size)
+			}
+		}
+
+		switch seg.Type {
+		case SegmentCrypt:
+			if !dig.hasSegment(id) {
+				return nil, fmt.Errorf("segment %d is encrypted with a different volume key", id)
+			}
+			ivTweak, err := seg.IvTweak.Int64()
+			if err != nil {
+				return nil, err
+			}
+			if seg.SectorSize == 0 || (seg.Size != "dynamic" && size%uint64(seg.SectorSize) != 0) {
+				return nil, fmt.Errorf("segment %d size %d is not aligned to sector size %d", id, size, seg.SectorSize)
+			}
+			segments = append(segments, VolumeSegment{
+				Type:       SegmentCrypt,
+				Encryption: seg.Encryption,
+				IvTweak:    uint64(ivTweak),
+				SectorSize: uint64(seg.SectorSize),
+				Offset:     uint64(offset),
+				Size:       size,
+			})
+		case SegmentLinear:
+			segments = append(segments, VolumeSegment{
+				Type:       SegmentLinear,
+				SectorSize: storageSectorSize,
+				Offset:     uint64(offset),
+				Size:       size,
+			})
+		default:
+			return nil, fmt.Errorf("segment %d has unsupported type %v", id, seg.Type)
+		}
+	}
+	return segments, nil
+}
+
 func computeDigestForKey(dig *digest, keyslotIdx int, finalKey []byte) ([]byte, error) {
 	digSalt, err := base64.StdEncoding.DecodeString(dig.Salt)
 	if err != nil {
@@ -328,7 +889,11 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 	area := keyslot.Area
 
 	// decrypt keyslotIdx area using the derived key
-	keyslotSize := keyslot.KeySize * stripesNum
+	af := keyslot.Af
+	if af.Stripes == 0 {
+		return nil, fmt.Errorf("keyslot[%v] has invalid number of anti-forensic stripes", keyslotIdx)
+	}
+	keyslotSize := afSplitSize(int(keyslot.KeySize), int(af.Stripes))
 
 	areaSize, err := area.Size.Int64()
 	if err != nil {
@@ -337,9 +902,6 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 	if int64(keyslotSize) > areaSize {
 		return nil, fmt.Errorf("keyslot[%v] area size too small, given %v expected at least %v", keyslotIdx, areaSize, keyslotSize)
 	}
-	if keyslotSize%storageSectorSize != 0 {
-		return nil, fmt.Errorf("keyslot[%v] size %v is not multiple of the sector size %v", keyslotIdx, keyslotSize, storageSectorSize)
-	}
 
 	keyData := make([]byte, keyslotSize)
 	defer clearSlice(keyData)
@@ -356,21 +918,17 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 		return nil, err
 	}
 
-	ciph, err := buildLuks2AfCipher(area.Encryption, afKey)
+	ciph, err := newSectorCipher(area.Encryption, afKey)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := 0; i < int(keyslotSize/storageSectorSize); i++ {
+	for i := 0; i < keyslotSize/storageSectorSize; i++ {
 		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
 		ciph.Decrypt(block, block, uint64(i))
 	}
 
 	// anti-forensic merge
-	af := keyslot.Af
-	if af.Stripes != stripesNum {
-		return nil, fmt.Errorf("LUKS currently supports only af with 4000 stripes")
-	}
 	h, _ := getHashAlgo(af.Hash)
 	if h == nil {
 		return nil, fmt.Errorf("Unknown af hash algorithm: %v", af.Hash)
@@ -379,31 +937,7 @@ func (d *deviceV2) decryptLuks2VolumeKey(keyslotIdx int, keyslot keyslot, afKey
 	return afMerge(keyData, int(keyslot.KeySize), int(af.Stripes), h())
 }
 
-func buildLuks2AfCipher(encryption string, afKey []byte) (*xts.Cipher, error) {
-	// parse encryption mode for the keyslot area, see crypt_parse_name_and_mode()
-	// example of `encryption` value is 'aes-xts-plain64'
-	encParts := strings.Split(encryption, "-")
-	if len(encParts) != 3 {
-		return nil, fmt.Errorf("Unexpected encryption format: %v", encryption)
-	}
-	cipherName := encParts[0]
-	cipherMode := encParts[1]
-	// ivModeName := encParts[2]
-
-	cipherFunc, err := getCipher(cipherName)
-	if err != nil {
-		return nil, err
-	}
-
-	switch cipherMode {
-	case "xts":
-		return xts.NewCipher(cipherFunc, afKey)
-	default:
-		return nil, fmt.Errorf("Unknown encryption mode: %v", cipherMode)
-	}
-}
-
-func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint) ([]byte, error) {
+func deriveLuks2AfKey(kdf *kdf, keyslotIdx int, passphrase []byte, keyLength uint) ([]byte, error) {
 	salt, err := base64.StdEncoding.DecodeString(kdf.Salt)
 	if err != nil {
 		return nil, fmt.Errorf("keyslotIdx[%v].kdf.salt base64 parsing failed: %v", keyslotIdx, err)
@@ -411,13 +945,8 @@ func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint
 
 	switch kdf.Type {
 	case "pbkdf2":
-		var h func() hash.Hash
-		switch kdf.Hash {
-		case "sha256":
-			h = sha256.New
-		case "sha512":
-			h = sha512.New
-		default:
+		h, _ := getHashAlgo(kdf.Hash)
+		if h == nil {
 			return nil, fmt.Errorf("Unknown keyslotIdx[%v].kdf.hash algorithm: %v", keyslotIdx, kdf.Hash)
 		}
 		return pbkdf2.Key(passphrase, salt, int(kdf.Iterations), int(keyLength), h), nil
@@ -432,15 +961,248 @@ func deriveLuks2AfKey(kdf kdf, keyslotIdx int, passphrase []byte, keyLength uint
 
 func (d *deviceV2) findDigestForKeyslot(keyslotIdx int) *digest {
 	for _, dig := range d.meta.Digests {
-		for _, k := range dig.Keyslots {
-			k, e := k.Int64()
-			if e != nil {
-				continue
-			}
-			if int(k) == keyslotIdx {
-				return &dig
-			}
+		if dig.hasKeyslot(keyslotIdx) {
+			return &dig
+		}
+	}
+	return nil
+}
+
+func (dig *digest) hasKeyslot(keyslotIdx int) bool {
+	for _, k := range dig.Keyslots {
+		k, e := k.Int64()
+		if e != nil {
+			continue
+		}
+		if int(k) == keyslotIdx {
+			return true
+		}
+	}
+	return false
+}
+
+func (dig *digest) hasSegment(segmentIdx int) bool {
+	for _, s := range dig.Segments {
+		s, e := s.Int64()
+		if e != nil {
+			continue
+		}
+		if int(s) == segmentIdx {
+			return true
+		}
+	}
+	return false
+}
+
+// isBackup reports whether the segment is a reencryption backup record rather than volume data
+func (seg *segment) isBackup() bool {
+	for _, f := range seg.Flags {
+		if strings.HasPrefix(f, "backup-") {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	luks2MagicPrimary   = []byte("LUKS\xba\xbe")
+	luks2MagicSecondary = []byte("SKUL\xba\xbe")
+)
+
+const (
+	// size of the binary header, JSON metadata area starts right after it
+	luks2BinaryHeaderSize = 4096
+	// default size of a header copy (binary header + JSON area), see LUKS2_HDR_16K_LEN
+	luks2DefaultHeaderSize = 0x4000
+	// default offset of the data segment
+	luks2DefaultDataOffset = 16 * 1024 * 1024
+	// keyslot areas are aligned to this value
+	luks2KeyslotAlignment = 4096
+	// number of iterations used for the volume key digest, see LUKS_MKD_ITERATIONS_MIN
+	digestIterations = 1000
+)
+
+// headerV2Checksum calculates checksum of the whole header copy (binary header + JSON area).
+// Note that it clears the checksum field of the binary header stored in data.
+func headerV2Checksum(algo string, data []byte) ([]byte, error) {
+	h, size := getHashAlgo(algo)
+	if h == nil {
+		return nil, fmt.Errorf("Unknown header checksum algorithm: %v", algo)
+	}
+	if size > len(headerV2{}.Checksum) {
+		return nil, fmt.Errorf("header checksum algorithm %v digest size %d is too large", algo, size)
+	}
+
+	checksumOffset := int(unsafe.Offsetof(headerV2{}.Checksum))
+	clearSlice(data[checksumOffset : checksumOffset+len(headerV2{}.Checksum)])
+
+	hasher := h()
+	hasher.Write(data)
+	return hasher.Sum(nil), nil
+}
+
+// writeV2Headers serializes the metadata and writes both primary and secondary copies of the header
+func writeV2Headers(w io.WriterAt, hdr *headerV2, meta *metadata) error {
+	jsonData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	hdrSize := hdr.HeaderSize
+	// JSON area must contain at least one NUL byte after the metadata
+	if uint64(len(jsonData)) >= hdrSize-luks2BinaryHeaderSize {
+		return fmt.Errorf("LUKS2 metadata size %d does not fit into JSON area of size %d", len(jsonData), hdrSize-luks2BinaryHeaderSize)
+	}
+
+	for _, offset := range []uint64{0, hdrSize} {
+		copyHdr := *hdr
+		copyHdr.HeaderOffset = offset
+		if offset == 0 {
+			copy(copyHdr.Magic[:], luks2MagicPrimary)
+		} else {
+			copy(copyHdr.Magic[:], luks2MagicSecondary)
+		}
+		if _, err := rand.Read(copyHdr.Salt[:]); err != nil {
+			return err
+		}
+
+		data := make([]byte, hdrSize)
+		copy(data[luks2BinaryHeaderSize:], jsonData)
+		if err := encodeHeaderV2(&copyHdr, data); err != nil {
+			return err
+		}
+
+		checksum, err := headerV2Checksum(fixedArrayToString(copyHdr.ChecksumAlgorithm[:]), data)
+		if err != nil {
+			return err
+		}
+		copy(copyHdr.Checksum[:], checksum)
+		if err := encodeHeaderV2(&copyHdr, data); err != nil {
+			return err
 		}
+
+		if _, err := w.WriteAt(data, int64(offset)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func encodeHeaderV2(hdr *headerV2, data []byte) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, hdr); err != nil {
+		return err
 	}
+	copy(data, buf.Bytes())
 	return nil
 }
+
+// createLuks2Keyslot derives a key from the passphrase, encrypts AF-split volume key with it and writes
+// the resulting key material to w at areaOffset. It returns metadata of the new keyslot.
+func createLuks2Keyslot(w io.WriterAt, keyslotIdx int, volumeKey, passphrase []byte, encryption string, areaOffset uint64, opts KDFOptions) (*keyslot, error) {
+	kdf, err := newLuks2Kdf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	keySize := uint(len(volumeKey))
+	afKey, err := deriveLuks2AfKey(kdf, keyslotIdx, passphrase, keySize)
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(afKey)
+
+	h, _ := getHashAlgo(opts.Hash)
+	if h == nil {
+		return nil, fmt.Errorf("Unknown af hash algorithm: %v", opts.Hash)
+	}
+	splitKey, err := afSplit(volumeKey, stripesNum, h())
+	if err != nil {
+		return nil, err
+	}
+	defer clearSlice(splitKey)
+
+	keyData := make([]byte, roundUp(len(splitKey), storageSectorSize))
+	defer clearSlice(keyData)
+	copy(keyData, splitKey)
+
+	ciph, err := newSectorCipher(encryption, afKey)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(keyData)/storageSectorSize; i++ {
+		block := keyData[i*storageSectorSize : (i+1)*storageSectorSize]
+		ciph.Encrypt(block, block, uint64(i))
+	}
+
+	if _, err := w.WriteAt(keyData, int64(areaOffset)); err != nil {
+		return nil, err
+	}
+
+	areaSize := roundUp(len(keyData), luks2KeyslotAlignment)
+	return &keyslot{
+		Type:    "luks2",
+		KeySize: keySize,
+		Af: &antiForensic{
+			Type:    "luks1",
+			Stripes: stripesNum,
+			Hash:    opts.Hash,
+		},
+		Area: area{
+			Type:       "raw",
+			Encryption: encryption,
+			KeySize:    keySize,
+			Offset:     jsonNumber(areaOffset),
+			Size:       jsonNumber(uint64(areaSize)),
+		},
+		Kdf: kdf,
+	}, nil
+}
+
+// newLuks2Kdf generates a new salt and returns kdf metadata for the given options
+func newLuks2Kdf(opts KDFOptions) (*kdf, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	k := kdf{
+		Type: opts.Type,
+		Salt: base64.StdEncoding.EncodeToString(salt),
+	}
+	switch opts.Type {
+	case "pbkdf2":
+		k.Hash = opts.Hash
+		k.Iterations = opts.Iterations
+	case "argon2i", "argon2id":
+		k.Time = opts.Time
+		k.Memory = opts.Memory
+		k.Cpus = opts.Threads
+	default:
+		return nil, fmt.Errorf("Unknown kdf type: %v", opts.Type)
+	}
+	return &k, nil
+}
+
+// createLuks2Digest computes a digest of the volume key that is used to verify keys recovered from keyslots
+func createLuks2Digest(volumeKey []byte, keyslots, segments []int) (*digest, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	algo := "sha256"
+	h, size := getHashAlgo(algo)
+	digestValue := pbkdf2.Key(volumeKey, salt, digestIterations, size, h)
+
+	return &digest{
+		Type:       "pbkdf2",
+		Keyslots:   toQuotedNumbers(keyslots),
+		Segments:   toQuotedNumbers(segments),
+		Hash:       algo,
+		Iterations: digestIterations,
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Digest:     base64.StdEncoding.EncodeToString(digestValue),
+	}, nil
+}
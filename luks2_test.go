@@ -1,6 +1,8 @@
 package luks
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -89,6 +91,15 @@ func TestLuks2Hashes(t *testing.T) {
 	}
 }
 
+func TestLuks2Pbkdf2Hashes(t *testing.T) {
+	hashes := []string{"sha1", "sha224", "sha256", "sha384", "sha512", "sha3-224", "sha3-256", "sha3-384", "sha3-512", "ripemd160", "blake2b-512", "blake2s-256", "whirlpool"}
+	for _, h := range hashes {
+		t.Run(h, func(t *testing.T) {
+			runLuks2Test(t, 0, "--pbkdf", "pbkdf2", "--pbkdf-force-iterations", "1000", "--hash", h)
+		})
+	}
+}
+
 func TestLuks2CamelliaBlockCipher(t *testing.T) {
 	runLuks2Test(t, 0, "--cipher", "camellia-xts-plain64", "--key-size", "512", "--hash", "sha512", "--iter-time", "800", "--pbkdf", "argon2id", "--pbkdf-memory", "41000")
 }
@@ -97,6 +108,14 @@ func TestLuks2TwofishBlockCipher(t *testing.T) {
 	runLuks2Test(t, 0, "--cipher", "twofish-xts-plain64")
 }
 
+func TestLuks2SerpentBlockCipher(t *testing.T) {
+	runLuks2Test(t, 0, "--cipher", "serpent-xts-plain64")
+}
+
+func TestLuks2CbcEssiv(t *testing.T) {
+	runLuks2Test(t, 0, "--cipher", "aes-cbc-essiv:sha256", "--key-size", "256")
+}
+
 func TestLuks2WithIntegrity(t *testing.T) {
 	// dm-integrity requires 'root'
 	curr, err := user.Current()
@@ -211,3 +230,622 @@ func TestLuks2PreferedPriority(t *testing.T) {
 
 	require.ElementsMatch(t, []int{0}, d.Slots())
 }
+
+func TestLuks2AddKey(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.AddKey([]byte("wrongpassword"), []byte("newpwd"), nil)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	slot, err := dev.AddKey([]byte(password), []byte("newpwd1"), &KDFOptions{Type: "argon2id", Time: 4, Memory: 32, Threads: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	slot, err = dev.AddKey([]byte("newpwd1"), []byte("newpwd2"), &testKdf)
+	require.NoError(t, err)
+	require.Equal(t, 2, slot)
+
+	d, err := initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), d.hdr.SequenceID)
+	require.ElementsMatch(t, []int{0, 1, 2}, d.Slots())
+
+	// keyslot areas must not overlap
+	require.Equal(t, "32768", d.meta.Keyslots[0].Area.Offset.String())
+	require.Equal(t, "290816", d.meta.Keyslots[1].Area.Offset.String())
+	require.Equal(t, "548864", d.meta.Keyslots[2].Area.Offset.String())
+	require.Len(t, d.meta.Digests[0].Keyslots, 3)
+
+	v0, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	v1, err := d.UnsealVolume(1, []byte("newpwd1"))
+	require.NoError(t, err)
+	require.Equal(t, v0.key, v1.key)
+	v2, err := d.UnsealVolume(2, []byte("newpwd2"))
+	require.NoError(t, err)
+	require.Equal(t, v0.key, v2.key)
+}
+
+func TestLuks2AddKeyCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk, err := prepareLuks2Disk(password, "--key-slot", "2")
+	require.NoError(t, err)
+	defer disk.Close()
+	defer os.Remove(disk.Name())
+
+	d, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer d.Close()
+
+	password2 := "newpwd"
+	slot, err := d.AddKey([]byte(password), []byte(password2), &testKdf)
+	require.NoError(t, err)
+	require.Equal(t, 0, slot)
+
+	openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--key-slot", "0", disk.Name())
+	openCmd.Stdin = strings.NewReader(password2)
+	if testing.Verbose() {
+		openCmd.Stdout = os.Stdout
+		openCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, openCmd.Run())
+}
+
+func TestLuks2KillSlot(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.AddKey([]byte(password), []byte("newpwd1"), &testKdf)
+	require.NoError(t, err)
+	_, err = dev.AddKey([]byte(password), []byte("newpwd2"), &testKdf)
+	require.NoError(t, err)
+
+	// assign a token to keyslots 1 and 2
+	d := dev.(*deviceV2)
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"clevis","keyslots":["1","2"],"jwe":{}}`)
+	f, err := os.OpenFile(disk.Name(), os.O_RDWR, 0)
+	require.NoError(t, err)
+	require.NoError(t, d.writeHeaders(f))
+	require.NoError(t, f.Close())
+
+	require.NoError(t, dev.KillSlot(1, false))
+	require.Error(t, dev.KillSlot(1, false))
+	require.NoError(t, dev.RemoveKey([]byte("newpwd2"), false))
+
+	d, err = initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, quotedNumbers{"0"}, d.meta.Digests[0].Keyslots)
+
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Empty(t, tokens[0].Slots)
+	require.Equal(t, "clevis", tokens[0].Type)
+
+	// the freed area is reused by a new keyslot
+	slot, err := d.AddKey([]byte(password), []byte("newpwd3"), &testKdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+	require.Equal(t, "290816", d.meta.Keyslots[1].Area.Offset.String())
+
+	require.NoError(t, d.KillSlot(0, false))
+	require.Equal(t, ErrLastKeyslot, d.KillSlot(1, false))
+	require.Equal(t, ErrLastKeyslot, d.RemoveKey([]byte("newpwd3"), false))
+	require.NoError(t, d.RemoveKey([]byte("newpwd3"), true))
+	require.Empty(t, d.Slots())
+}
+
+func TestLuks2ChangeKey(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	require.Equal(t, ErrPassphraseDoesNotMatch, dev.ChangeKey(0, []byte("wrongpassword"), []byte("newpwd"), nil))
+	require.NoError(t, dev.ChangeKey(0, []byte(password), []byte("newpwd"), nil))
+
+	d := dev.(*deviceV2)
+	require.Equal(t, "pbkdf2", d.meta.Keyslots[0].Kdf.Type)
+	require.Equal(t, uint(1000), d.meta.Keyslots[0].Kdf.Iterations)
+	require.Equal(t, "290816", d.meta.Keyslots[0].Area.Offset.String())
+
+	require.NoError(t, dev.ChangeKey(0, []byte("newpwd"), []byte("newpwd2"), &KDFOptions{Type: "argon2i", Time: 4, Memory: 32, Threads: 1}))
+
+	d, err = initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, d.Slots())
+	require.Equal(t, "argon2i", d.meta.Keyslots[0].Kdf.Type)
+	require.Equal(t, "32768", d.meta.Keyslots[0].Area.Offset.String())
+
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	_, err = d.UnsealVolume(0, []byte("newpwd"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+	v2, err := d.UnsealVolume(0, []byte("newpwd2"))
+	require.NoError(t, err)
+	require.Equal(t, v.key, v2.key)
+}
+
+func TestLuks2KeyslotWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+	d := dev.(*deviceV2)
+	before, err := json.Marshal(d.meta)
+	require.NoError(t, err)
+
+	// the metadata does not fit into the header thus it cannot be written
+	headerSize := d.hdr.HeaderSize
+	d.hdr.HeaderSize = luks2BinaryHeaderSize
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.ErrorContains(t, err, "does not fit into JSON area")
+	err = dev.ChangeKey(0, []byte(password), []byte("newpwd"), nil)
+	require.ErrorContains(t, err, "does not fit into JSON area")
+
+	// the in-memory metadata matches the device
+	after, err := json.Marshal(d.meta)
+	require.NoError(t, err)
+	require.JSONEq(t, string(before), string(after))
+	d.hdr.HeaderSize = headerSize
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	slot, err := dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+	require.Equal(t, 1, slot)
+}
+
+func TestLuks2SecondaryHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	d, err := Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), d.HeaderOffset())
+	require.NoError(t, d.Close())
+
+	// damage JSON area of the primary header
+	_, err = disk.WriteAt([]byte("garbage"), 4096)
+	require.NoError(t, err)
+
+	d, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, uint64(16384), d.HeaderOffset())
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	// damage the first sector, including the magic
+	_, err = disk.WriteAt(make([]byte, 512), 0)
+	require.NoError(t, err)
+
+	d, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, 2, d.Version())
+	require.Equal(t, uint64(16384), d.HeaderOffset())
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	// header modification restores the primary header copy
+	_, err = d.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+	require.NoError(t, d.Close())
+
+	d, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), d.HeaderOffset())
+	require.NoError(t, d.Close())
+
+	// both copies are damaged
+	_, err = disk.WriteAt(make([]byte, 512), 0)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(make([]byte, 512), 16384)
+	require.NoError(t, err)
+	_, err = Open(disk.Name())
+	require.Error(t, err)
+}
+
+func TestLuks2SecondaryHeaderNewerSequence(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	// emulate an interrupted header update where only the secondary copy got the new metadata
+	primary := make([]byte, 16384)
+	_, err = disk.ReadAt(primary, 0)
+	require.NoError(t, err)
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+	_, err = disk.WriteAt(primary, 0)
+	require.NoError(t, err)
+
+	d, err := initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	require.Equal(t, uint64(16384), d.HeaderOffset())
+	require.Equal(t, uint64(2), d.hdr.SequenceID)
+	require.ElementsMatch(t, []int{0, 1}, d.Slots())
+}
+
+func TestLuks2DetachedHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	header := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(header.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	data := prepareEmptyDisk(t, 32*1024*1024)
+
+	d, err := OpenWithHeader(header.Name(), data.Name())
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, header.Name(), d.Path())
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, data.Name(), v.BackingDevice)
+	require.Equal(t, uint64(16*1024*1024), v.StorageOffset)
+	require.Equal(t, uint64(16*1024*1024), v.StorageSize)
+
+	// header modifications go to the header file
+	_, err = d.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+	_, err = Open(data.Name())
+	require.Error(t, err)
+
+	_, err = OpenWithHeader(header.Name(), "/nonexistent/data/device")
+	require.Error(t, err)
+}
+
+func TestLuks2DetachedHeaderCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	header := prepareEmptyDisk(t, 0)
+	data := prepareEmptyDisk(t, 8*1024*1024)
+
+	cmd := exec.Command("cryptsetup", "luksFormat", "--type", "luks2", "--iter-time", "5", "-q", "--header", header.Name(), data.Name())
+	cmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	require.NoError(t, cmd.Run())
+
+	d, err := OpenWithHeader(header.Name(), data.Name())
+	require.NoError(t, err)
+	defer d.Close()
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, data.Name(), v.BackingDevice)
+	require.Equal(t, uint64(0), v.StorageOffset)
+	require.Equal(t, uint64(8*1024*1024), v.StorageSize)
+}
+
+func TestLuks2BackupRestoreHeader(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	var backup bytes.Buffer
+	require.NoError(t, dev.BackupHeader(&backup))
+	require.Equal(t, 16*1024*1024, backup.Len())
+
+	// restoring over the same device is fine
+	require.NoError(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()), false))
+
+	// destroy the header and then restore it
+	_, err = disk.WriteAt(make([]byte, 16*1024*1024), 0)
+	require.NoError(t, err)
+	_, err = Open(disk.Name())
+	require.Error(t, err)
+
+	require.ErrorContains(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()), false), "use force")
+	require.NoError(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()), true))
+	d, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer d.Close()
+	require.Equal(t, dev.UUID(), d.UUID())
+	_, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	// the backup does not belong to another device
+	other := prepareEmptyDisk(t, 24*1024*1024)
+	otherDev, err := Format(other.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer otherDev.Close()
+	require.Error(t, RestoreHeader(other.Name(), bytes.NewReader(backup.Bytes()), true))
+
+	// device is too small
+	small := prepareEmptyDisk(t, 8*1024*1024)
+	require.Error(t, RestoreHeader(small.Name(), bytes.NewReader(backup.Bytes()), true))
+
+	// truncated backup
+	require.Error(t, RestoreHeader(disk.Name(), bytes.NewReader(backup.Bytes()[:1024*1024]), true))
+
+	// corrupted backup
+	corrupted := bytes.Clone(backup.Bytes())
+	corrupted[4096] = 'x'
+	corrupted[16384+4096] = 'x'
+	require.Error(t, RestoreHeader(disk.Name(), bytes.NewReader(corrupted), true))
+}
+
+func TestLuks2OpenReaderAt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	image, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+
+	d, err := OpenReaderAt(bytes.NewReader(image), int64(len(image)))
+	require.NoError(t, err)
+	defer d.Close()
+
+	require.Equal(t, 2, d.Version())
+	require.Equal(t, "", d.Path())
+	require.Equal(t, dev.UUID(), d.UUID())
+	require.ElementsMatch(t, []int{0, 1}, d.Slots())
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+
+	v, err := d.UnsealVolume(1, []byte("newpwd"))
+	require.NoError(t, err)
+	require.Equal(t, "", v.BackingDevice)
+	require.Equal(t, uint64(8*1024*1024), v.StorageSize)
+	require.Error(t, v.SetupMapper("luks.go.test"))
+
+	// the device is read-only
+	_, err = d.AddKey([]byte(password), []byte("newpwd2"), &testKdf)
+	require.Error(t, err)
+
+	// the size limits the readable region
+	d, err = OpenReaderAt(bytes.NewReader(image), 20*1024*1024)
+	require.NoError(t, err)
+	v, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4*1024*1024), v.StorageSize)
+
+	_, err = OpenReaderAt(bytes.NewReader(image), 1024)
+	require.Error(t, err)
+}
+
+func TestLuks2NonStandardStripes(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	d := dev.(*deviceV2)
+
+	// re-create the keyslot material with a single stripe, i.e. the AF-split key is the volume key itself
+	ks := d.meta.Keyslots[0]
+	afKey, err := deriveLuks2AfKey(ks.Kdf, 0, []byte(password), ks.KeySize)
+	require.NoError(t, err)
+	material := make([]byte, afSplitSize(len(v.key), 1))
+	copy(material, v.key)
+	ciph, err := newSectorCipher(ks.Area.Encryption, afKey)
+	require.NoError(t, err)
+	ciph.Encrypt(material, material, 0)
+	offset, err := ks.Area.Offset.Int64()
+	require.NoError(t, err)
+	_, err = disk.WriteAt(material, offset)
+	require.NoError(t, err)
+
+	ks.Af.Stripes = 1
+	ks.Area.Size = jsonNumber(luks2KeyslotAlignment)
+	d.meta.Keyslots[0] = ks
+	require.NoError(t, d.writeHeaders(disk))
+	require.NoError(t, dev.Close())
+
+	d2, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer d2.Close()
+	v2, err := d2.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Equal(t, v.key, v2.key)
+
+	_, err = d2.UnsealVolume(0, []byte("wrongpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	// the stripes do not fit into the keyslot area
+	ks.Af.Stripes = 100
+	d2.(*deviceV2).meta.Keyslots[0] = ks
+	_, err = d2.UnsealVolume(0, []byte(password))
+	require.Error(t, err)
+	require.NotEqual(t, ErrPassphraseDoesNotMatch, err)
+}
+
+func TestLuks2HeaderChecksumAlgorithms(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	for _, algo := range []string{"sha1", "sha512", "sha3-256", "blake2b-512", "whirlpool", "stribog512"} {
+		d, err := initV2Device(disk.Name(), disk)
+		require.NoError(t, err)
+		copy(d.hdr.ChecksumAlgorithm[:], make([]byte, len(d.hdr.ChecksumAlgorithm)))
+		copy(d.hdr.ChecksumAlgorithm[:], algo)
+		require.NoError(t, d.writeHeaders(disk))
+
+		d, err = initV2Device(disk.Name(), disk)
+		require.NoError(t, err, algo)
+		require.Equal(t, algo, fixedArrayToString(d.hdr.ChecksumAlgorithm[:]))
+		_, err = d.UnsealVolume(0, []byte(password))
+		require.NoError(t, err)
+	}
+
+	d, err := initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	copy(d.hdr.ChecksumAlgorithm[:], "foo\x00")
+	require.Error(t, d.writeHeaders(disk))
+}
+
+func TestLuks2Requirements(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.Empty(t, dev.Requirements())
+
+	d := dev.(*deviceV2)
+	d.meta.Config.Requirements = &requirements{Mandatory: []string{"online-reencrypt-v2"}}
+	require.NoError(t, d.writeHeaders(disk))
+	require.NoError(t, dev.Close())
+
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, []string{"online-reencrypt-v2"}, dev.Requirements())
+
+	var reqErr *UnsupportedRequirementError
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.ErrorAs(t, err, &reqErr)
+	require.Equal(t, "online-reencrypt-v2", reqErr.Requirement)
+
+	require.ErrorAs(t, dev.UnlockAny([]byte(password), "luks.go.test"), &reqErr)
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.ErrorAs(t, err, &reqErr)
+	require.ErrorAs(t, dev.ChangeKey(0, []byte(password), []byte("newpwd"), &testKdf), &reqErr)
+	require.ErrorAs(t, dev.KillSlot(0, true), &reqErr)
+
+	// the metadata is still readable
+	require.Equal(t, []int{0}, dev.Slots())
+	var backup bytes.Buffer
+	require.NoError(t, dev.BackupHeader(&backup))
+}
+
+func TestLuks2Tokens(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = dev.AddKey([]byte(password), []byte("newpwd"), &testKdf)
+	require.NoError(t, err)
+
+	payload := `{"type":"ignored","keyslots":["5"],"jwe":{"protected":"test"}}`
+	id, err := dev.TokenImport(Token{ID: -1, Slots: []int{0, 1}, Type: "clevis", Payload: []byte(payload)})
+	require.NoError(t, err)
+	require.Equal(t, 0, id)
+	id, err = dev.TokenImport(Token{ID: 5, Slots: []int{1}, Type: "systemd-fido2"})
+	require.NoError(t, err)
+	require.Equal(t, 5, id)
+	id, err = dev.TokenImport(Token{ID: -1, Type: "systemd-tpm2"})
+	require.NoError(t, err)
+	require.Equal(t, 1, id)
+
+	for _, token := range []Token{
+		{ID: 0, Type: "clevis"},                          // the id is in use
+		{ID: luks2TokensMax, Type: "clevis"},             // the id is out of range
+		{ID: -1},                                         // no type
+		{ID: -1, Type: "clevis", Slots: []int{2}},        // the keyslot does not exist
+		{ID: -1, Type: "clevis", Payload: []byte(`[1]`)}, // the payload is not an object
+	} {
+		_, err := dev.TokenImport(token)
+		require.Error(t, err, "%+v", token)
+	}
+
+	d, err := initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	token, err := d.TokenExport(0)
+	require.NoError(t, err)
+	require.Equal(t, "clevis", token.Type)
+	require.Equal(t, []int{0, 1}, token.Slots)
+	require.JSONEq(t, `{"type":"clevis","keyslots":["0","1"],"jwe":{"protected":"test"}}`, string(token.Payload))
+	token, err = d.TokenExport(5)
+	require.NoError(t, err)
+	require.Equal(t, Token{ID: 5, Slots: []int{1}, Type: "systemd-fido2", Payload: []byte(`{"keyslots":["1"],"type":"systemd-fido2"}`)}, token)
+	_, err = d.TokenExport(2)
+	require.Error(t, err)
+
+	// the exported token can be imported back
+	require.NoError(t, d.TokenRemove(0))
+	require.Error(t, d.TokenRemove(0))
+	id, err = d.TokenImport(Token{ID: 3, Slots: []int{1}, Type: "clevis", Payload: token.Payload})
+	require.NoError(t, err)
+	require.Equal(t, 3, id)
+
+	d, err = initV2Device(disk.Name(), disk)
+	require.NoError(t, err)
+	tokens, err := d.Tokens()
+	require.NoError(t, err)
+	ids := make([]int, 0)
+	for _, t := range tokens {
+		ids = append(ids, t.ID)
+	}
+	require.ElementsMatch(t, []int{1, 3, 5}, ids)
+}
+
+func TestLuks2TokenImportCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "barfoo"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	payload := `{"jwe":{"ciphertext":"","encrypted_key":"","iv":"","protected":"test","tag":""}}`
+	_, err = dev.TokenImport(Token{ID: 2, Slots: []int{0}, Type: "clevis", Payload: []byte(payload)})
+	require.NoError(t, err)
+
+	out, err := exec.Command("cryptsetup", "token", "export", "--token-id", "2", disk.Name()).Output()
+	require.NoError(t, err)
+	require.JSONEq(t, `{"type":"clevis","keyslots":["0"],"jwe":{"ciphertext":"","encrypted_key":"","iv":"","protected":"test","tag":""}}`, string(out))
+}
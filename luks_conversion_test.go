@@ -1,6 +1,10 @@
 package luks
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -115,3 +119,204 @@ func TestConvertV2toV1(t *testing.T) {
 	_, err = d3.UnsealVolume(0, []byte(password))
 	require.NoError(t, err)
 }
+
+// writeVolumeData fills the volume with random data and returns it
+func writeVolumeData(t *testing.T, dev Device, password string) []byte {
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	data := make([]byte, v.StorageSize)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	w, err := v.NewWriterAt()
+	require.NoError(t, err)
+	_, err = w.WriteAt(data, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return data
+}
+
+// checkVolumeData verifies that the passphrase unseals the keyslot and the volume contains the data
+func checkVolumeData(t *testing.T, dev Device, keyslot int, password string, data []byte) {
+	v, err := dev.UnsealVolume(keyslot, []byte(password))
+	require.NoError(t, err)
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	decrypted := make([]byte, len(data))
+	_, err = io.ReadFull(r, decrypted)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+}
+
+func TestConvert(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KeySize: 256, KDF: testKdf})
+	require.NoError(t, err)
+	uuid := dev.UUID()
+	_, err = dev.AddKey([]byte(password), []byte("otherpassword"), &testKdf)
+	require.NoError(t, err)
+	data := writeVolumeData(t, dev, password)
+	require.NoError(t, dev.Close())
+
+	dev, err = Convert(disk.Name(), 2, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, 2, dev.Version())
+	require.Equal(t, uuid, dev.UUID())
+	require.ElementsMatch(t, []int{0, 1}, dev.Slots())
+	d := dev.(*deviceV2)
+	require.Equal(t, jsonNumber(2*luks2DefaultHeaderSize), d.meta.Keyslots[0].Area.Offset)
+	require.Equal(t, jsonNumber(2*1024*1024-2*luks2DefaultHeaderSize), d.meta.Config.KeyslotsSize)
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+	checkVolumeData(t, dev, 0, password, data)
+	checkVolumeData(t, dev, 1, "otherpassword", data)
+
+	// the converted device is fully functional
+	slot, err := dev.AddKey([]byte(password), []byte("thirdpassword"), &testKdf)
+	require.NoError(t, err)
+	require.Equal(t, 2, slot)
+	require.NoError(t, dev.Close())
+
+	_, err = Convert(disk.Name(), 2, io.Discard)
+	require.Error(t, err)
+
+	dev, err = Convert(disk.Name(), 1, io.Discard)
+	require.NoError(t, err)
+	defer dev.Close()
+	require.Equal(t, 1, dev.Version())
+	require.Equal(t, uuid, dev.UUID())
+	require.Equal(t, []int{0, 1, 2}, dev.Slots())
+	checkVolumeData(t, dev, 0, password, data)
+	checkVolumeData(t, dev, 1, "otherpassword", data)
+	checkVolumeData(t, dev, 2, "thirdpassword", data)
+}
+
+func TestConvertLuksMeta(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		_, err = dev.AddKey([]byte(password), []byte(fmt.Sprintf("password%d", i)), &testKdf)
+		require.NoError(t, err)
+	}
+	jwe := "eyJhbGciOiJFQ0RILUVTIn0..aXY.Y2lwaGVydGV4dA.dGFn"
+	for _, slot := range []int{1, 2} {
+		_, err = dev.TokenImport(Token{ID: -1, Slots: []int{slot}, Type: "clevis", Payload: []byte(jwe)})
+		require.NoError(t, err)
+	}
+	// the metadata of the removed keyslot 2 becomes stale
+	require.NoError(t, dev.KillSlot(2, false))
+	require.NoError(t, dev.Close())
+
+	dev, err = Convert(disk.Name(), 2, io.Discard)
+	require.NoError(t, err)
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.Equal(t, 1, tokens[0].ID)
+	require.Equal(t, "clevis", tokens[0].Type)
+	require.Equal(t, []int{1}, tokens[0].Slots)
+	require.JSONEq(t, `{"type":"clevis","keyslots":["1"],"jwe":{"protected":"eyJhbGciOiJFQ0RILUVTIn0","encrypted_key":"","iv":"aXY","ciphertext":"Y2lwaGVydGV4dA","tag":"dGFn"}}`, string(tokens[0].Payload))
+	_, err = dev.UnsealVolume(1, []byte("password1"))
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	// LUKS1 does not support tokens
+	_, err = Convert(disk.Name(), 1, io.Discard)
+	require.Error(t, err)
+}
+
+func TestConvertInvalid(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	for _, opts := range []*FormatOptions{
+		{KDF: KDFOptions{Type: "argon2id", Time: 1, Memory: 32 * 1024, Threads: 1}},
+		{KDF: testKdf, SectorSize: 4096},
+		{KDF: KDFOptions{Type: "pbkdf2", Hash: "sha512", Iterations: 1000}}, // the digest uses sha256
+	} {
+		disk := prepareEmptyDisk(t, 24*1024*1024)
+		dev, err := Format(disk.Name(), []byte(password), opts)
+		require.NoError(t, err)
+		require.NoError(t, dev.Close())
+
+		var backup bytes.Buffer
+		_, err = Convert(disk.Name(), 1, &backup)
+		require.Error(t, err, "%+v", opts)
+		require.Zero(t, backup.Len(), "the backup is taken only after the converted header is checked")
+
+		// the device is left intact
+		dev, err = Open(disk.Name())
+		require.NoError(t, err)
+		require.Equal(t, 2, dev.Version())
+		_, err = dev.UnsealVolume(0, []byte(password))
+		require.NoError(t, err)
+		require.NoError(t, dev.Close())
+	}
+
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+	_, err = Convert(disk.Name(), 3, io.Discard)
+	require.Error(t, err)
+	_, err = Convert(disk.Name(), 1, nil)
+	require.Error(t, err)
+}
+
+func TestConvertRestoreBackup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	for _, version := range []int{1, 2} {
+		disk := prepareEmptyDisk(t, 24*1024*1024)
+		dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: version, KDF: testKdf})
+		require.NoError(t, err)
+		data := writeVolumeData(t, dev, password)
+		require.NoError(t, dev.Close())
+
+		var backup bytes.Buffer
+		dev, err = Convert(disk.Name(), 3-version, &backup)
+		require.NoError(t, err)
+		require.Equal(t, 3-version, dev.Version())
+		require.NoError(t, dev.Close())
+
+		// the backup taken by Convert returns the device to its original state
+		require.NoError(t, RestoreHeader(disk.Name(), &backup, true))
+		dev, err = Open(disk.Name())
+		require.NoError(t, err)
+		require.Equal(t, version, dev.Version())
+		checkVolumeData(t, dev, 0, password, data)
+		require.NoError(t, dev.Close())
+	}
+}
+
+func TestConvertCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	for _, version := range []int{2, 1} {
+		dev, err = Convert(disk.Name(), version, io.Discard)
+		require.NoError(t, err)
+		require.NoError(t, dev.Close())
+
+		openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--type", fmt.Sprintf("luks%d", version), disk.Name())
+		openCmd.Stdin = strings.NewReader(password)
+		if testing.Verbose() {
+			openCmd.Stdout = os.Stdout
+			openCmd.Stderr = os.Stderr
+		}
+		require.NoError(t, openCmd.Run())
+	}
+}
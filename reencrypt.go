@@ -0,0 +1,1159 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Resilience modes that protect the data chunk being reencrypted (hotzone) against a crash or power loss
+const (
+	ResilienceChecksum = "checksum" // checksums of the hotzone sectors tell which of them are rewritten already
+	ResilienceJournal  = "journal"  // the hotzone data is copied to the keyslots area before it is rewritten
+	ResilienceNone     = "none"     // no protection, an interrupted hotzone cannot be recovered
+)
+
+const (
+	// requirement that prevents the device from being used while reencryption is in progress
+	reencryptRequirement = "online-reencrypt-v2"
+	// version of the reencryption metadata, it matches the requirement version
+	reencryptVersion = 2
+	// segment flags used by the reencryption segment layout
+	segmentFlagInReencryption = "in-reencryption"
+	segmentFlagBackupPrevious = "backup-previous"
+	segmentFlagBackupFinal    = "backup-final"
+	segmentFlagBackupMoved    = "backup-moved-segment"
+
+	// modes and directions of the reencrypt keyslot
+	modeReencrypt     = "reencrypt"
+	modeEncrypt       = "encrypt"
+	modeDecrypt       = "decrypt"
+	directionForward  = "forward"
+	directionBackward = "backward"
+	// resilience of the encryption that shifts the data, the moved data is never overwritten before it is committed
+	resilienceDatashift = "datashift"
+
+	defaultHotzoneSize   = 4 * 1024 * 1024
+	defaultReencryptHash = "sha256"
+)
+
+// ReencryptOptions specifies parameters of the data encryption after reencryption.
+// Zero value fields keep the current parameters of the volume or use defaults.
+type ReencryptOptions struct {
+	// Cipher is the new data encryption specification e.g. "aes-xts-plain64"
+	Cipher string
+	// KeySize is the size of the new volume key in bits
+	KeySize int
+	// SectorSize is the new encryption sector size in bytes
+	SectorSize uint64
+	// KDF specifies parameters of the keyslot that protects the new volume key.
+	// If it is nil then the parameters of the keyslot unlocked by the passphrase are used.
+	KDF *KDFOptions
+	// Resilience is one of ResilienceChecksum (default), ResilienceJournal or ResilienceNone
+	Resilience string
+	// Hash is the hash algorithm used by the checksum resilience mode
+	Hash string
+	// HotzoneSize is the maximum size of data reencrypted in one step
+	HotzoneSize uint64
+}
+
+// ReencryptProgress is called after every reencrypted chunk of data with the number of bytes processed so far
+// and the total size of the data. Returning an error stops reencryption, it can be resumed later.
+type ReencryptProgress func(done, total uint64) error
+
+// Reencrypt replaces the volume key of a LUKS2 device (optionally changing the cipher, key size and sector size)
+// and reencrypts the data in place. It is an equivalent of offline `cryptsetup reencrypt`.
+//
+// The new volume key is stored in a new keyslot protected with the same passphrase. Other keyslots protect
+// the old volume key only, they are removed once reencryption finishes. The data is processed in chunks and
+// the progress is stored in the LUKS2 metadata, so an interrupted reencryption is resumed by calling Reencrypt
+// again with the same passphrase, opts are ignored in this case. cryptsetup is able to resume it as well. The device must not be in use while it is reencrypted.
+func Reencrypt(dev Device, passphrase []byte, opts *ReencryptOptions, progress ReencryptProgress) error {
+	d, ok := dev.(*deviceV2)
+	if !ok {
+		return fmt.Errorf("reencryption is supported for LUKS2 devices only")
+	}
+
+	r, err := d.openReencryption()
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	if r.keyslot == -1 {
+		err = r.init(passphrase, opts)
+	} else if r.mode != modeReencrypt {
+		err = fmt.Errorf("reencryption in %v mode is in progress", r.mode)
+	} else {
+		err = r.load(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	return r.run(progress)
+}
+
+// reencryption holds the state of LUKS2 reencryption, the state is stored in the metadata as the "reencrypt"
+// keyslot and the reencryption segments layout
+type reencryption struct {
+	d  *deviceV2
+	hf *os.File // header storage
+	df *os.File // data storage
+
+	keyslot     int // id of the reencrypt keyslot, -1 if reencryption is not in progress
+	mode        string
+	hotzoneSize uint64
+
+	// data segment parameters before and after reencryption, the size is the whole data size
+	oldSegment, newSegment VolumeSegment
+	oldDynamic, newDynamic bool // size of the segment follows the device size
+	oldKey, newKey         []byte
+	oldDigest, newDigest   int // -1 for linear segments
+	oldKeyslot, newKeyslot int // keyslots unlocked by the passphrase
+
+	oldData, newData *volumeReader
+	source           io.ReaderAt // plaintext of the data that is not reencrypted yet
+
+	// encryption moves the data towards the end of the device by shift bytes to make space for the header,
+	// the beginning of the data is kept at movedOffset until it is encrypted
+	shift, movedOffset uint64
+
+	size    uint64 // size of the data
+	offset  uint64 // data is reencrypted up to this offset, or starting from it in backward direction
+	hotzone uint64 // size of the hotzone that is marked as being reencrypted
+}
+
+// openReencryption opens the device storage for writing and checks whether reencryption is in progress already
+func (d *deviceV2) openReencryption() (*reencryption, error) {
+	for _, req := range d.Requirements() {
+		if req != reencryptRequirement && !supportedRequirements[req] {
+			return nil, &UnsupportedRequirementError{Requirement: req}
+		}
+	}
+
+	r := &reencryption{d: d, keyslot: -1, oldDigest: -1, newDigest: -1, oldKeyslot: -1, newKeyslot: -1}
+	for id, ks := range d.meta.Keyslots {
+		if ks.Type == "reencrypt" {
+			r.keyslot, r.mode = id, ks.Mode
+		}
+	}
+
+	hf, err := openForWriting(d.path)
+	if err != nil {
+		return nil, err
+	}
+	r.hf, r.df = hf, hf
+	if d.dataPath != d.path {
+		if r.df, err = os.OpenFile(d.dataPath, os.O_RDWR, 0); err != nil {
+			hf.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *reencryption) close() {
+	clearSlice(r.oldKey)
+	clearSlice(r.newKey)
+	if r.df != r.hf {
+		r.df.Close()
+	}
+	r.hf.Close()
+}
+
+// init starts reencryption: it creates the new volume key, a keyslot for it and the reencrypt keyslot
+func (r *reencryption) init(passphrase []byte, opts *ReencryptOptions) error {
+	d := r.d
+	var o ReencryptOptions
+	if opts != nil {
+		o = *opts
+	}
+	r.mode = modeReencrypt
+
+	segmentID, seg, err := d.singleCryptSegment()
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range d.Slots() {
+		key, _, err := d.unsealKey(slot, passphrase)
+		if err == ErrPassphraseDoesNotMatch {
+			continue
+		} else if err != nil {
+			return err
+		}
+		r.oldKey, r.oldKeyslot = key, slot
+		break
+	}
+	if r.oldKey == nil {
+		return ErrPassphraseDoesNotMatch
+	}
+	r.oldDigest = d.digestForKeyslot(r.oldKeyslot)
+
+	r.oldSegment, r.oldDynamic, err = segmentParams(seg)
+	if err != nil {
+		return err
+	}
+	if dig := d.meta.Digests[r.oldDigest]; !dig.hasSegment(segmentID) {
+		return fmt.Errorf("segment %d is encrypted with a different volume key", segmentID)
+	}
+
+	if o.Cipher == "" {
+		o.Cipher = r.oldSegment.Encryption
+	}
+	if o.KeySize == 0 {
+		o.KeySize = len(r.oldKey) * 8
+	}
+	if o.SectorSize == 0 {
+		o.SectorSize = r.oldSegment.SectorSize
+	}
+	if o.Resilience == "" {
+		o.Resilience = ResilienceChecksum
+	}
+	if o.Hash == "" {
+		o.Hash = defaultReencryptHash
+	}
+	if o.HotzoneSize == 0 {
+		o.HotzoneSize = defaultHotzoneSize
+	}
+	oldKs := d.meta.Keyslots[r.oldKeyslot]
+	kdfOpts := kdfOptionsFromKeyslot(oldKs)
+	if o.KDF != nil {
+		kdfOpts = *o.KDF
+	}
+	kdfOpts = kdfOpts.withDefaults()
+
+	if o.KeySize <= 0 || o.KeySize%8 != 0 {
+		return fmt.Errorf("invalid key size %v, it must be a multiple of 8 bits", o.KeySize)
+	}
+	if o.SectorSize < storageSectorSize || o.SectorSize > 4096 || !isPowerOfTwo(uint(o.SectorSize)) {
+		return fmt.Errorf("invalid sector size %v", o.SectorSize)
+	}
+
+	r.newKey = make([]byte, o.KeySize/8)
+	if _, err := rand.Read(r.newKey); err != nil {
+		return err
+	}
+	if _, err := newSectorCipher(o.Cipher, r.newKey); err != nil {
+		return err
+	}
+	r.newSegment = VolumeSegment{
+		Type:       SegmentCrypt,
+		Encryption: o.Cipher,
+		SectorSize: o.SectorSize,
+		Offset:     r.oldSegment.Offset,
+	}
+	r.newDynamic = r.oldDynamic
+	if err := r.setDataSize(); err != nil {
+		return err
+	}
+
+	// the hotzone must consist of whole sectors of both old and new segments
+	alignment := r.alignment()
+	if r.size%alignment != 0 {
+		return fmt.Errorf("data size %d is not aligned to sector size %d", r.size, alignment)
+	}
+	r.hotzoneSize = o.HotzoneSize - o.HotzoneSize%alignment
+	if r.hotzoneSize == 0 {
+		return fmt.Errorf("hotzone size %d is smaller than sector size %d", o.HotzoneSize, alignment)
+	}
+
+	resilience, areaSize, err := r.resilienceArea(o.Resilience, o.Hash)
+	if err != nil {
+		return err
+	}
+
+	// the new keyslot and the resilience area are allocated at once before the metadata is modified
+	keyslotSize := uint64(roundUp(len(r.newKey)*stripesNum, luks2KeyslotAlignment))
+	keyslotOffset, err := d.allocateKeyslotArea(keyslotSize + areaSize)
+	if err != nil {
+		return err
+	}
+	resilience.Offset = jsonNumber(keyslotOffset + keyslotSize)
+	resilience.Size = jsonNumber(areaSize)
+
+	// the new key is protected with the same passphrase
+	newSlot, err := d.freeKeyslot()
+	if err != nil {
+		return err
+	}
+	ks, err := createLuks2Keyslot(r.hf, newSlot, r.newKey, passphrase, oldKs.Area.Encryption, keyslotOffset, kdfOpts)
+	if err != nil {
+		return err
+	}
+	ks.Priority = oldKs.Priority
+	d.meta.Keyslots[newSlot] = *ks
+	r.newKeyslot = newSlot
+
+	dig, err := createLuks2Digest(r.newKey, []int{newSlot}, nil)
+	if err != nil {
+		return err
+	}
+	r.newDigest = d.freeDigest()
+	d.meta.Digests[r.newDigest] = *dig
+
+	if err := r.addReencryptKeyslot(resilience); err != nil {
+		return err
+	}
+	if err := r.openData(); err != nil {
+		return err
+	}
+	if err := r.addReencryptDigest(); err != nil {
+		return err
+	}
+	return r.commit()
+}
+
+// singleCryptSegment returns the data segment of a device that is not being reencrypted
+func (d *deviceV2) singleCryptSegment() (int, segment, error) {
+	var segmentID int
+	var seg segment
+	for id, s := range d.meta.Segments {
+		segmentID, seg = id, s
+	}
+	if len(d.meta.Segments) != 1 || seg.Type != SegmentCrypt {
+		return 0, segment{}, fmt.Errorf("device must have a single crypt segment")
+	}
+	return segmentID, seg, nil
+}
+
+// resilienceArea returns the resilience area parameters and its size for the hotzone size, the offset is not set
+func (r *reencryption) resilienceArea(resilience, hash string) (area, uint64, error) {
+	a := area{Type: resilience}
+	var size uint64
+	switch resilience {
+	case ResilienceChecksum:
+		_, hashSize := getHashAlgo(hash)
+		if hashSize == 0 {
+			return area{}, 0, fmt.Errorf("Unknown checksum hash algorithm: %v", hash)
+		}
+		a.Hash = hash
+		a.SectorSize = uint(r.alignment())
+		size = r.hotzoneSize / r.alignment() * uint64(hashSize)
+	case ResilienceJournal:
+		size = r.hotzoneSize
+	case ResilienceNone:
+		size = 0
+	default:
+		return area{}, 0, fmt.Errorf("Unknown resilience mode: %v", resilience)
+	}
+	size = uint64(roundUp(int(size), luks2KeyslotAlignment))
+	if size == 0 {
+		size = luks2KeyslotAlignment
+	}
+	return a, size, nil
+}
+
+// addReencryptKeyslot adds the reencrypt keyslot with the resilience area and marks the device as being reencrypted
+func (r *reencryption) addReencryptKeyslot(resilience area) error {
+	d := r.d
+	var err error
+	if r.keyslot, err = d.freeKeyslot(); err != nil {
+		return err
+	}
+	d.meta.Keyslots[r.keyslot] = keyslot{
+		Type:      "reencrypt",
+		KeySize:   1,
+		Area:      resilience,
+		Mode:      r.mode,
+		Direction: directionForward,
+	}
+
+	if d.meta.Config.Requirements == nil {
+		d.meta.Config.Requirements = &requirements{}
+	}
+	d.meta.Config.Requirements.Mandatory = append(d.meta.Config.Requirements.Mandatory, reencryptRequirement)
+	return nil
+}
+
+// addReencryptDigest sets up the reencryption segments layout and adds the digest that authenticates it.
+// The digest is assigned to the reencrypt keyslot, cryptsetup refuses to resume reencryption without it.
+func (r *reencryption) addReencryptDigest() error {
+	r.updateSegments()
+	data, err := r.verificationData()
+	if err != nil {
+		return err
+	}
+	defer clearSlice(data)
+
+	dig, err := createLuks2Digest(data, []int{r.keyslot}, nil)
+	if err != nil {
+		return err
+	}
+	r.d.meta.Digests[r.d.freeDigest()] = *dig
+	return nil
+}
+
+// verifyReencryptDigest checks that the reencryption metadata was created by someone who knows the volume keys
+func (r *reencryption) verifyReencryptDigest() error {
+	id := r.d.digestForKeyslot(r.keyslot)
+	if id == -1 {
+		return fmt.Errorf("reencryption metadata digest is not found")
+	}
+	dig := r.d.meta.Digests[id]
+
+	data, err := r.verificationData()
+	if err != nil {
+		return err
+	}
+	defer clearSlice(data)
+	generated, err := computeDigestForKey(&dig, r.keyslot, data)
+	if err != nil {
+		return err
+	}
+	expected, err := base64.StdEncoding.DecodeString(dig.Digest)
+	if err != nil {
+		return fmt.Errorf("reencryption digest base64 parsing failed: %v", err)
+	}
+	if !bytes.Equal(generated, expected) {
+		return fmt.Errorf("reencryption metadata is invalid")
+	}
+	return nil
+}
+
+// verificationData serializes the volume keys, the reencrypt keyslot and the backup segments the same way as
+// cryptsetup does. Integers are big-endian, strings are stored without a terminator.
+func (r *reencryption) verificationData() ([]byte, error) {
+	data := []byte{'v', '0' + reencryptVersion}
+	if r.oldDigest != -1 {
+		data = append(data, r.oldKey...)
+	}
+	if r.newDigest != -1 && r.newDigest != r.oldDigest {
+		data = append(data, r.newKey...)
+	}
+	if len(data) == 2 {
+		return nil, fmt.Errorf("reencryption does not have a volume key")
+	}
+
+	ks := r.d.meta.Keyslots[r.keyslot]
+	var err error
+	data = append(data, ks.Mode...)
+	data = append(data, ks.Direction...)
+	data = append(data, ks.Area.Type...)
+	if data, err = appendNumber(data, ks.Area.Offset); err != nil {
+		return nil, err
+	}
+	if data, err = appendNumber(data, ks.Area.Size); err != nil {
+		return nil, err
+	}
+	switch ks.Area.Type {
+	case ResilienceChecksum:
+		data = append(data, ks.Area.Hash...)
+		data = binary.BigEndian.AppendUint32(data, uint32(ks.Area.SectorSize))
+	case resilienceDatashift:
+		if data, err = appendNumber(data, ks.Area.ShiftSize); err != nil {
+			return nil, err
+		}
+	case ResilienceJournal, ResilienceNone:
+	default:
+		return nil, fmt.Errorf("Unknown resilience mode: %v", ks.Area.Type)
+	}
+
+	for _, flag := range []string{segmentFlagBackupPrevious, segmentFlagBackupFinal, segmentFlagBackupMoved} {
+		found := false
+		for _, seg := range r.d.meta.Segments {
+			if !hasFlag(seg.Flags, flag) {
+				continue
+			}
+			if data, err = appendSegment(data, seg); err != nil {
+				return nil, err
+			}
+			found = true
+			break
+		}
+		if !found && flag != segmentFlagBackupMoved {
+			return nil, fmt.Errorf("reencryption backup segments are not found")
+		}
+	}
+	return data, nil
+}
+
+// appendSegment serializes the segment parameters for the reencryption digest
+func appendSegment(data []byte, seg segment) ([]byte, error) {
+	var err error
+	data = append(data, seg.Type...)
+	if data, err = appendNumber(data, seg.Offset); err != nil {
+		return nil, err
+	}
+	if seg.Size == "dynamic" {
+		data = append(data, seg.Size...)
+	} else if data, err = appendNumber(data, json.Number(seg.Size)); err != nil {
+		return nil, err
+	}
+
+	switch seg.Type {
+	case SegmentLinear:
+	case SegmentCrypt:
+		if data, err = appendNumber(data, seg.IvTweak); err != nil {
+			return nil, err
+		}
+		data = append(data, seg.Encryption...)
+		data = binary.BigEndian.AppendUint32(data, uint32(seg.SectorSize))
+	default:
+		return nil, fmt.Errorf("unsupported segment type %v", seg.Type)
+	}
+	return data, nil
+}
+
+func appendNumber(data []byte, n json.Number) ([]byte, error) {
+	v, err := strconv.ParseUint(string(n), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(data, v), nil
+}
+
+// load reads the reencryption state from the metadata and recovers the volume keys
+func (r *reencryption) load(passphrase []byte) error {
+	d := r.d
+	ks := d.meta.Keyslots[r.keyslot]
+	if ks.Mode == modeEncrypt && ks.Direction == directionBackward {
+		return r.loadEncryption(ks, passphrase)
+	}
+	if (ks.Mode != modeReencrypt && ks.Mode != modeDecrypt) || ks.Direction != directionForward {
+		return fmt.Errorf("unsupported reencryption mode %v, direction %v", ks.Mode, ks.Direction)
+	}
+
+	previousID, finalID := -1, -1
+	for id, seg := range d.meta.Segments {
+		for _, f := range seg.Flags {
+			switch f {
+			case segmentFlagBackupPrevious:
+				previousID = id
+			case segmentFlagBackupFinal:
+				finalID = id
+			}
+		}
+	}
+	if previousID == -1 || finalID == -1 {
+		return fmt.Errorf("reencryption backup segments are not found")
+	}
+
+	var err error
+	r.oldSegment, r.oldDynamic, err = segmentParams(d.meta.Segments[previousID])
+	if err != nil {
+		return err
+	}
+	r.newSegment, r.newDynamic, err = segmentParams(d.meta.Segments[finalID])
+	if err != nil {
+		return err
+	}
+	for id, dig := range d.meta.Digests {
+		if dig.hasSegment(previousID) {
+			r.oldDigest = id
+		}
+		if dig.hasSegment(finalID) {
+			r.newDigest = id
+		}
+	}
+	if err := r.setDataSize(); err != nil {
+		return err
+	}
+	if err := r.unsealKeys(passphrase); err != nil {
+		return err
+	}
+	if err := r.verifyReencryptDigest(); err != nil {
+		return err
+	}
+
+	// find the reencryption progress, the segments are ordered as [new data][hotzone][old data]
+	ids := make([]int, 0, len(d.meta.Segments))
+	for id, seg := range d.meta.Segments {
+		if !seg.isBackup() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	r.offset = r.size
+	var pos uint64
+	for _, id := range ids {
+		seg := d.meta.Segments[id]
+		size := r.size - pos
+		if seg.Size != "dynamic" {
+			if size, err = strconv.ParseUint(seg.Size, 10, 64); err != nil {
+				return err
+			}
+		}
+		if hasFlag(seg.Flags, segmentFlagInReencryption) {
+			r.offset, r.hotzone = pos, size
+			break
+		}
+		isNew := seg.Type == r.newSegment.Type
+		if seg.Type == SegmentCrypt {
+			dig, ok := d.meta.Digests[r.newDigest]
+			isNew = ok && dig.hasSegment(id)
+		}
+		if !isNew {
+			r.offset = pos
+			break
+		}
+		pos += size
+	}
+	if r.offset+r.hotzone > r.size || r.offset%r.alignment() != 0 {
+		return fmt.Errorf("invalid reencryption segments layout")
+	}
+
+	areaSize, err := ks.Area.Size.Int64()
+	if err != nil {
+		return err
+	}
+	alignment := r.alignment()
+	switch ks.Area.Type {
+	case ResilienceChecksum:
+		_, hashSize := getHashAlgo(ks.Area.Hash)
+		if hashSize == 0 {
+			return fmt.Errorf("Unknown checksum hash algorithm: %v", ks.Area.Hash)
+		}
+		if uint64(ks.Area.SectorSize) != alignment {
+			return fmt.Errorf("invalid checksum sector size %d", ks.Area.SectorSize)
+		}
+		r.hotzoneSize = uint64(areaSize) / uint64(hashSize) * alignment
+	case ResilienceJournal:
+		r.hotzoneSize = uint64(areaSize)
+	case ResilienceNone:
+		r.hotzoneSize = defaultHotzoneSize
+	default:
+		return fmt.Errorf("Unknown resilience mode: %v", ks.Area.Type)
+	}
+	r.hotzoneSize -= r.hotzoneSize % alignment
+	if r.hotzoneSize == 0 || r.hotzone > r.hotzoneSize {
+		return fmt.Errorf("resilience area of size %d is too small", areaSize)
+	}
+
+	return r.openData()
+}
+
+// unsealKeys recovers the old and new volume keys from the keyslots unlocked by the passphrase
+func (r *reencryption) unsealKeys(passphrase []byte) error {
+	d := r.d
+	for _, slot := range d.Slots() {
+		digestID := d.digestForKeyslot(slot)
+		isOld := digestID == r.oldDigest && r.oldKey == nil
+		isNew := digestID == r.newDigest && r.newKey == nil
+		if digestID == -1 || (!isOld && !isNew) {
+			continue
+		}
+		key, _, err := d.unsealKey(slot, passphrase)
+		if err == ErrPassphraseDoesNotMatch {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if isOld {
+			r.oldKey, r.oldKeyslot = key, slot
+		} else {
+			r.newKey, r.newKeyslot = key, slot
+		}
+	}
+	if (r.oldDigest != -1 && r.oldKey == nil) || (r.newDigest != -1 && r.newKey == nil) {
+		return ErrPassphraseDoesNotMatch
+	}
+	return nil
+}
+
+// segmentParams converts LUKS2 segment metadata to VolumeSegment, the size is not set if it is dynamic
+func segmentParams(seg segment) (VolumeSegment, bool, error) {
+	offset, err := seg.Offset.Int64()
+	if err != nil {
+		return VolumeSegment{}, false, err
+	}
+	s := VolumeSegment{Type: seg.Type, Offset: uint64(offset)}
+	if seg.Size != "dynamic" {
+		if s.Size, err = strconv.ParseUint(seg.Size, 10, 64); err != nil {
+			return VolumeSegment{}, false, err
+		}
+	}
+	switch seg.Type {
+	case SegmentCrypt:
+		ivTweak, err := seg.IvTweak.Int64()
+		if err != nil {
+			return VolumeSegment{}, false, err
+		}
+		s.Encryption = seg.Encryption
+		s.IvTweak = uint64(ivTweak)
+		s.SectorSize = uint64(seg.SectorSize)
+	case SegmentLinear:
+		s.SectorSize = storageSectorSize
+	default:
+		return VolumeSegment{}, false, fmt.Errorf("unsupported segment type %v", seg.Type)
+	}
+	return s, seg.Size == "dynamic", nil
+}
+
+// luks2Segment returns metadata of the data range [start, start+size) of the segment
+func luks2Segment(s VolumeSegment, start, size uint64, dynamic bool) segment {
+	seg := segment{
+		Type:   s.Type,
+		Offset: jsonNumber(s.Offset + start),
+		Size:   strconv.FormatUint(size, 10),
+	}
+	if dynamic {
+		seg.Size = "dynamic"
+	}
+	if s.Type == SegmentCrypt {
+		// dm-crypt IV is counted from the beginning of the data
+		seg.IvTweak = jsonNumber(s.IvTweak + start/storageSectorSize)
+		seg.Encryption = s.Encryption
+		seg.SectorSize = uint(s.SectorSize)
+	}
+	return seg
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// digestForKeyslot returns id of the digest assigned to the keyslot or -1
+func (d *deviceV2) digestForKeyslot(keyslotIdx int) int {
+	for id, dig := range d.meta.Digests {
+		if dig.hasKeyslot(keyslotIdx) {
+			return id
+		}
+	}
+	return -1
+}
+
+// freeDigest returns the lowest unused digest id
+func (d *deviceV2) freeDigest() int {
+	id := 0
+	for {
+		if _, ok := d.meta.Digests[id]; !ok {
+			return id
+		}
+		id++
+	}
+}
+
+// setDataSize computes the size of the data from the old segment
+func (r *reencryption) setDataSize() error {
+	if !r.oldDynamic {
+		r.size = r.oldSegment.Size
+		return nil
+	}
+
+	size, err := fileSize(r.df)
+	if err != nil {
+		return err
+	}
+	if size <= r.oldSegment.Offset {
+		return fmt.Errorf("backing file size %d is smaller than LUKS segment offset %d", size, r.oldSegment.Offset)
+	}
+	r.size = size - r.oldSegment.Offset
+	return nil
+}
+
+// alignment returns the granularity of reencryption
+func (r *reencryption) alignment() uint64 {
+	if r.oldSegment.SectorSize > r.newSegment.SectorSize {
+		return r.oldSegment.SectorSize
+	}
+	return r.newSegment.SectorSize
+}
+
+// openData creates readers of the old and new data layouts
+func (r *reencryption) openData() error {
+	r.oldSegment.Size = r.size
+	r.newSegment.Size = r.size
+	var err error
+	if r.oldData, err = newVolumeReader(r.df, r.oldSegment, r.oldKey); err != nil {
+		return err
+	}
+	if r.newData, err = newVolumeReader(r.df, r.newSegment, r.newKey); err != nil {
+		return err
+	}
+	if r.mode == modeEncrypt {
+		return r.openMovedData()
+	}
+	r.source = r.oldData
+	return nil
+}
+
+// remaining returns the size of the data that is not reencrypted yet
+func (r *reencryption) remaining() uint64 {
+	if r.mode == modeEncrypt {
+		return r.offset
+	}
+	return r.size - r.offset
+}
+
+func (r *reencryption) run(progress ReencryptProgress) error {
+	if r.hotzone != 0 {
+		if err := r.recoverHotzone(); err != nil {
+			return err
+		}
+	}
+
+	for r.remaining() > 0 {
+		size := r.hotzoneSize
+		if size > r.remaining() {
+			size = r.remaining()
+		}
+		if err := r.reencryptHotzone(size); err != nil {
+			return err
+		}
+		if progress != nil {
+			if err := progress(r.size-r.remaining(), r.size); err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.finalize()
+}
+
+// reencryptHotzone reencrypts the next size bytes of data
+func (r *reencryption) reencryptHotzone(size uint64) error {
+	if err := r.beginHotzone(size); err != nil {
+		return err
+	}
+
+	start := r.hotzoneStart()
+	buf := make([]byte, size)
+	defer clearSlice(buf)
+	if _, err := r.source.ReadAt(buf, int64(start)); err != nil {
+		return err
+	}
+	if err := r.writeData(buf, start); err != nil {
+		return err
+	}
+	return r.endHotzone()
+}
+
+// hotzoneStart returns the data offset of the hotzone
+func (r *reencryption) hotzoneStart() uint64 {
+	if r.mode == modeEncrypt {
+		return r.offset - r.hotzone
+	}
+	return r.offset
+}
+
+// beginHotzone stores the resilience data of the hotzone and marks it as being reencrypted in the metadata
+func (r *reencryption) beginHotzone(size uint64) error {
+	ks := r.d.meta.Keyslots[r.keyslot]
+	if ks.Area.Type == resilienceDatashift {
+		// the source of the shifted hotzone is left intact, an interrupted hotzone is simply encrypted again
+		r.hotzone = size
+		return nil
+	}
+	areaOffset, err := ks.Area.Offset.Int64()
+	if err != nil {
+		return err
+	}
+
+	if ks.Area.Type != ResilienceNone {
+		raw := make([]byte, size)
+		if _, err := r.df.ReadAt(raw, int64(r.oldSegment.Offset+r.offset)); err != nil {
+			return err
+		}
+		if ks.Area.Type == ResilienceChecksum {
+			if raw, err = r.checksums(raw); err != nil {
+				return err
+			}
+		}
+		if _, err := r.hf.WriteAt(raw, areaOffset); err != nil {
+			return err
+		}
+		if err := r.hf.Sync(); err != nil {
+			return err
+		}
+	}
+
+	r.hotzone = size
+	return r.commit()
+}
+
+// endHotzone marks the hotzone as reencrypted in the metadata
+func (r *reencryption) endHotzone() error {
+	if r.mode == modeEncrypt {
+		r.offset -= r.hotzone
+	} else {
+		r.offset += r.hotzone
+	}
+	r.hotzone = 0
+	return r.commit()
+}
+
+// checksums computes checksums of every resilience sector of the data
+func (r *reencryption) checksums(data []byte) ([]byte, error) {
+	ks := r.d.meta.Keyslots[r.keyslot]
+	h, _ := getHashAlgo(ks.Area.Hash)
+	if h == nil {
+		return nil, fmt.Errorf("Unknown checksum hash algorithm: %v", ks.Area.Hash)
+	}
+	sectorSize := int(ks.Area.SectorSize)
+
+	var sums []byte
+	for i := 0; i < len(data); i += sectorSize {
+		hasher := h()
+		hasher.Write(data[i : i+sectorSize])
+		sums = hasher.Sum(sums)
+	}
+	return sums, nil
+}
+
+// writeData encrypts the plaintext with the new parameters and writes it at the data offset
+func (r *reencryption) writeData(buf []byte, offset uint64) error {
+	r.newData.encrypt(buf, int64(offset))
+	if _, err := r.df.WriteAt(buf, int64(r.newSegment.Offset+offset)); err != nil {
+		return err
+	}
+	return r.df.Sync()
+}
+
+// recoverHotzone finishes reencryption of the hotzone that has been interrupted
+func (r *reencryption) recoverHotzone() error {
+	ks := r.d.meta.Keyslots[r.keyslot]
+	areaOffset, err := ks.Area.Offset.Int64()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, r.hotzone)
+	defer clearSlice(buf)
+
+	switch ks.Area.Type {
+	case ResilienceChecksum:
+		// sectors that match the stored checksums still contain the old data
+		if _, err := r.df.ReadAt(buf, int64(r.oldSegment.Offset+r.offset)); err != nil {
+			return err
+		}
+		sums, err := r.checksums(buf)
+		if err != nil {
+			return err
+		}
+		stored := make([]byte, len(sums))
+		if _, err := r.hf.ReadAt(stored, areaOffset); err != nil {
+			return err
+		}
+		sectorSize := uint64(ks.Area.SectorSize)
+		hashSize := len(sums) / int(r.hotzone/sectorSize)
+		for i := uint64(0); i < r.hotzone; i += sectorSize {
+			j := int(i/sectorSize) * hashSize
+			sector := buf[i : i+sectorSize]
+			if bytes.Equal(sums[j:j+hashSize], stored[j:j+hashSize]) {
+				r.oldData.decrypt(sector, int64(r.offset+i))
+			} else {
+				r.newData.decrypt(sector, int64(r.offset+i))
+			}
+		}
+	case ResilienceJournal:
+		// the journal contains the old data of the whole hotzone
+		if _, err := r.hf.ReadAt(buf, areaOffset); err != nil {
+			return err
+		}
+		r.oldData.decrypt(buf, int64(r.offset))
+	default:
+		return fmt.Errorf("reencryption of data at offset %d was interrupted and resilience mode %v does not allow to recover it", r.offset, ks.Area.Type)
+	}
+
+	if err := r.writeData(buf, r.offset); err != nil {
+		return err
+	}
+	return r.endHotzone()
+}
+
+// commit writes the segments layout of the current reencryption progress to the metadata
+func (r *reencryption) commit() error {
+	r.updateSegments()
+	if err := r.d.writeHeaders(r.hf); err != nil {
+		return err
+	}
+	return r.hf.Sync()
+}
+
+// updateSegments sets the metadata segments to the current reencryption layout
+func (r *reencryption) updateSegments() {
+	var entries []layoutEntry
+	if r.mode == modeEncrypt {
+		entries = r.encryptionLayout()
+	} else {
+		entries = r.reencryptionLayout()
+	}
+
+	var oldSegments, newSegments []int
+	segments := make(map[int]segment, len(entries))
+	for id, e := range entries {
+		segments[id] = e.seg
+		if e.seg.Type != SegmentCrypt {
+			continue
+		}
+		if e.isNew {
+			newSegments = append(newSegments, id)
+		} else {
+			oldSegments = append(oldSegments, id)
+		}
+	}
+
+	r.d.meta.Segments = segments
+	r.assignSegments(r.oldDigest, oldSegments)
+	r.assignSegments(r.newDigest, newSegments)
+}
+
+// layoutEntry is a segment of the reencryption layout, isNew tells whether it is encrypted with the new volume key
+type layoutEntry struct {
+	seg   segment
+	isNew bool
+}
+
+// reencryptionLayout returns the segments of forward reencryption ordered as [new data][hotzone][old data]
+// followed by the backup segments
+func (r *reencryption) reencryptionLayout() []layoutEntry {
+	var entries []layoutEntry
+	if r.offset > 0 {
+		entries = append(entries, layoutEntry{luks2Segment(r.newSegment, 0, r.offset, false), true})
+	}
+	if r.hotzone > 0 {
+		seg := luks2Segment(r.newSegment, r.offset, r.hotzone, false)
+		seg.Flags = []string{segmentFlagInReencryption}
+		entries = append(entries, layoutEntry{seg, true})
+	}
+	if rest := r.offset + r.hotzone; rest < r.size {
+		entries = append(entries, layoutEntry{luks2Segment(r.oldSegment, rest, r.size-rest, r.oldDynamic), false})
+	}
+	previous := luks2Segment(r.oldSegment, 0, r.size, r.oldDynamic)
+	previous.Flags = []string{segmentFlagBackupPrevious}
+	final := luks2Segment(r.newSegment, 0, r.size, r.newDynamic)
+	final.Flags = []string{segmentFlagBackupFinal}
+	return append(entries, layoutEntry{previous, false}, layoutEntry{final, true})
+}
+
+// assignSegments sets the list of segments verified by the digest
+func (r *reencryption) assignSegments(digestID int, segments []int) {
+	if digestID == -1 {
+		return
+	}
+	dig := r.d.meta.Digests[digestID]
+	dig.Segments = toQuotedNumbers(segments)
+	r.d.meta.Digests[digestID] = dig
+}
+
+// finalize switches the metadata to the new data segment and removes the old keyslots and the reencrypt keyslot
+func (r *reencryption) finalize() error {
+	if r.mode == modeDecrypt {
+		return r.removeHeader()
+	}
+	meta := r.d.meta
+
+	removed := []int{r.keyslot}
+	if id := r.d.digestForKeyslot(r.keyslot); id != -1 {
+		delete(meta.Digests, id)
+	}
+	if r.oldDigest != -1 {
+		for _, k := range meta.Digests[r.oldDigest].Keyslots {
+			id, err := k.Int64()
+			if err != nil {
+				return err
+			}
+			removed = append(removed, int(id))
+		}
+		delete(meta.Digests, r.oldDigest)
+	}
+
+	type region struct{ offset, size int64 }
+	var wipe []region
+	for _, id := range removed {
+		ks, ok := meta.Keyslots[id]
+		if !ok {
+			continue
+		}
+		offset, err := ks.Area.Offset.Int64()
+		if err != nil {
+			return err
+		}
+		size, err := ks.Area.Size.Int64()
+		if err != nil {
+			return err
+		}
+		wipe = append(wipe, region{offset, size})
+		delete(meta.Keyslots, id)
+	}
+
+	// tokens unlock the new keyslot as it is protected with the same passphrase
+	for id, t := range meta.Tokens {
+		token, err := replaceTokenKeyslot(t, r.oldKeyslot, r.newKeyslot)
+		if err != nil {
+			return err
+		}
+		for _, k := range removed {
+			if token, err = removeTokenKeyslot(token, k); err != nil {
+				return err
+			}
+		}
+		meta.Tokens[id] = token
+	}
+
+	meta.Segments = map[int]segment{0: luks2Segment(r.newSegment, 0, r.size, r.newDynamic)}
+	r.assignSegments(r.newDigest, []int{0})
+
+	var reqs []string
+	for _, req := range r.d.Requirements() {
+		if req != reencryptRequirement {
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) == 0 {
+		meta.Config.Requirements = nil
+	} else {
+		meta.Config.Requirements.Mandatory = reqs
+	}
+
+	if err := r.d.writeHeaders(r.hf); err != nil {
+		return err
+	}
+	for _, w := range wipe {
+		if err := wipeArea(r.hf, w.offset, w.size); err != nil {
+			return err
+		}
+	}
+	if r.mode == modeEncrypt {
+		// the moved copy of the plaintext is not needed anymore
+		if err := wipeArea(r.df, int64(r.movedOffset), int64(r.shift)); err != nil {
+			return err
+		}
+		if err := r.df.Sync(); err != nil {
+			return err
+		}
+	}
+	return r.hf.Sync()
+}
+
+// replaceTokenKeyslot assigns the token to the new keyslot if it is assigned to the old one
+func replaceTokenKeyslot(token json.RawMessage, oldIdx, newIdx int) (json.RawMessage, error) {
+	if oldIdx == -1 || newIdx == -1 {
+		return token, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(token, &fields); err != nil {
+		return nil, err
+	}
+	var keyslots quotedNumbers
+	if err := json.Unmarshal(fields["keyslots"], &keyslots); err != nil {
+		return nil, err
+	}
+
+	filtered := keyslots.without(oldIdx)
+	if len(filtered) == len(keyslots) {
+		// keep the token as-is
+		return token, nil
+	}
+
+	data, err := json.Marshal(append(filtered, jsonNumber(uint64(newIdx))))
+	if err != nil {
+		return nil, err
+	}
+	fields["keyslots"] = data
+	return json.Marshal(fields)
+}
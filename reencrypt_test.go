@@ -0,0 +1,418 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// prepareReencryptDisk formats a LUKS2 disk and fills the volume with random data
+func prepareReencryptDisk(t *testing.T, password string, opts *FormatOptions) (*os.File, []byte) {
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), opts)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	data := make([]byte, v.StorageSize)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	w, err := v.NewWriterAt()
+	require.NoError(t, err)
+	_, err = w.WriteAt(data, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return disk, data
+}
+
+// checkReencryptedDisk verifies that reencryption is finished and the volume contains the expected data
+func checkReencryptedDisk(t *testing.T, path, password string, data []byte) *Volume {
+	dev, err := Open(path)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	require.Empty(t, dev.Requirements())
+	d := dev.(*deviceV2)
+	require.Len(t, d.meta.Keyslots, 1)
+	require.Len(t, d.meta.Digests, 1)
+	require.Len(t, d.meta.Segments, 1)
+
+	v, _, err := unsealAny(dev, []byte(password))
+	require.NoError(t, err)
+	require.Empty(t, v.Segments)
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+	return v
+}
+
+func TestReencrypt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	oldVolume, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	var steps []uint64
+	progress := func(done, total uint64) error {
+		require.Equal(t, uint64(len(data)), total)
+		steps = append(steps, done)
+		return nil
+	}
+	require.NoError(t, Reencrypt(dev, []byte(password), &ReencryptOptions{HotzoneSize: 3 * 1024 * 1024}, progress))
+	require.Equal(t, []uint64{3 * 1024 * 1024, 6 * 1024 * 1024, 8 * 1024 * 1024}, steps)
+	require.Equal(t, []int{1}, dev.Slots())
+
+	// the device object is updated as well
+	v, err := dev.UnsealVolume(1, []byte(password))
+	require.NoError(t, err)
+	require.NotEqual(t, oldVolume.key, v.key)
+	require.NoError(t, dev.Close())
+
+	v = checkReencryptedDisk(t, disk.Name(), password, data)
+	require.Equal(t, oldVolume.StorageEncryption, v.StorageEncryption)
+	require.Equal(t, oldVolume.StorageSectorSize, v.StorageSectorSize)
+	require.Equal(t, oldVolume.StorageOffset, v.StorageOffset)
+	require.Len(t, v.key, len(oldVolume.key))
+}
+
+func TestReencryptParams(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	kdf := KDFOptions{Type: "argon2id", Time: 4, Memory: 32, Threads: 1}
+	opts := &ReencryptOptions{
+		Cipher:      "aes-cbc-essiv:sha256",
+		KeySize:     256,
+		SectorSize:  4096,
+		KDF:         &kdf,
+		Resilience:  ResilienceJournal,
+		HotzoneSize: 1024 * 1024,
+	}
+	require.NoError(t, Reencrypt(dev, []byte(password), opts, nil))
+	require.Equal(t, "argon2id", dev.(*deviceV2).meta.Keyslots[1].Kdf.Type)
+
+	v := checkReencryptedDisk(t, disk.Name(), password, data)
+	require.Equal(t, "aes-cbc-essiv:sha256", v.StorageEncryption)
+	require.Equal(t, uint64(4096), v.StorageSectorSize)
+	require.Len(t, v.key, 32)
+}
+
+func TestReencryptResilienceModes(t *testing.T) {
+	t.Parallel()
+
+	for _, resilience := range []string{ResilienceChecksum, ResilienceJournal, ResilienceNone} {
+		password := "foobar"
+		disk, data := prepareReencryptDisk(t, password, &FormatOptions{SectorSize: 4096, KDF: testKdf})
+		dev, err := Open(disk.Name())
+		require.NoError(t, err)
+
+		opts := &ReencryptOptions{Resilience: resilience, Hash: "sha512", SectorSize: 512, HotzoneSize: 512 * 1024}
+		require.NoError(t, Reencrypt(dev, []byte(password), opts, nil), resilience)
+		require.NoError(t, dev.Close())
+
+		v := checkReencryptedDisk(t, disk.Name(), password, data)
+		require.Equal(t, uint64(512), v.StorageSectorSize)
+	}
+}
+
+var errStopReencryption = fmt.Errorf("stop reencryption")
+
+// stopAfter returns a progress function that interrupts reencryption after the given number of steps
+func stopAfter(steps int) ReencryptProgress {
+	return func(done, total uint64) error {
+		steps--
+		if steps == 0 {
+			return errStopReencryption
+		}
+		return nil
+	}
+}
+
+func TestReencryptResume(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+
+	opts := &ReencryptOptions{Cipher: "twofish-xts-plain64", HotzoneSize: 1024 * 1024}
+	require.Equal(t, errStopReencryption, Reencrypt(dev, []byte(password), opts, stopAfter(3)))
+	require.NoError(t, dev.Close())
+
+	// the device cannot be used until reencryption is finished
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	require.Equal(t, []string{reencryptRequirement}, dev.Requirements())
+	var reqErr *UnsupportedRequirementError
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.ErrorAs(t, err, &reqErr)
+
+	d := dev.(*deviceV2)
+	require.Equal(t, "reencrypt", d.meta.Keyslots[2].Type)
+	require.Len(t, d.meta.Segments, 4)
+	require.Equal(t, "3145728", d.meta.Segments[0].Size)
+	require.Equal(t, "twofish-xts-plain64", d.meta.Segments[0].Encryption)
+	require.Equal(t, "aes-xts-plain64", d.meta.Segments[1].Encryption)
+	require.Equal(t, jsonNumber(16*1024*1024+3*1024*1024), d.meta.Segments[1].Offset)
+	require.Equal(t, jsonNumber(3*1024*1024/512), d.meta.Segments[1].IvTweak)
+	require.Equal(t, "dynamic", d.meta.Segments[1].Size)
+
+	err = Reencrypt(dev, []byte("wrongpassword"), nil, nil)
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	// the reencryption parameters are authenticated by a digest of the reencrypt keyslot
+	require.NotEqual(t, -1, d.digestForKeyslot(2))
+	final := d.meta.Segments[3]
+	require.Equal(t, []string{segmentFlagBackupFinal}, final.Flags)
+	d.meta.Segments[3] = segment{Type: SegmentCrypt, Offset: final.Offset, IvTweak: final.IvTweak, Size: final.Size,
+		Encryption: "aes-xts-plain64", SectorSize: final.SectorSize, Flags: final.Flags}
+	require.EqualError(t, Reencrypt(dev, []byte(password), nil, nil), "reencryption metadata is invalid")
+	d.meta.Segments[3] = final
+
+	var steps []uint64
+	progress := func(done, total uint64) error {
+		steps = append(steps, done)
+		return nil
+	}
+	require.NoError(t, Reencrypt(dev, []byte(password), nil, progress))
+	require.Len(t, steps, 5)
+	require.NoError(t, dev.Close())
+
+	v := checkReencryptedDisk(t, disk.Name(), password, data)
+	require.Equal(t, "twofish-xts-plain64", v.StorageEncryption)
+}
+
+func TestReencryptVerificationData(t *testing.T) {
+	t.Parallel()
+
+	d := &deviceV2{meta: &metadata{
+		Keyslots: map[int]keyslot{
+			2: {Type: "reencrypt", KeySize: 1, Mode: modeReencrypt, Direction: directionForward,
+				Area: area{Type: ResilienceChecksum, Offset: "32768", Size: "8192", Hash: "sha256", SectorSize: 4096}},
+		},
+		Segments: map[int]segment{
+			0: {Type: SegmentCrypt, Offset: "16777216", IvTweak: "0", Size: "1048576", Encryption: "twofish-xts-plain64", SectorSize: 4096},
+			1: {Type: SegmentCrypt, Offset: "17825792", IvTweak: "2048", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512},
+			2: {Type: SegmentCrypt, Offset: "16777216", IvTweak: "0", Size: "dynamic", Encryption: "aes-xts-plain64", SectorSize: 512,
+				Flags: []string{segmentFlagBackupPrevious}},
+			3: {Type: SegmentCrypt, Offset: "16777216", IvTweak: "0", Size: "8388608", Encryption: "twofish-xts-plain64", SectorSize: 4096,
+				Flags: []string{segmentFlagBackupFinal}},
+		},
+	}}
+	r := &reencryption{d: d, keyslot: 2, oldDigest: 0, newDigest: 1, oldKey: []byte{1, 2}, newKey: []byte{3, 4}}
+
+	expected := "v2" + "\x01\x02" + "\x03\x04" +
+		// reencrypt keyslot
+		"reencrypt" + "forward" + "checksum" + "\x00\x00\x00\x00\x00\x00\x80\x00" + "\x00\x00\x00\x00\x00\x00\x20\x00" +
+		"sha256" + "\x00\x00\x10\x00" +
+		// backup-previous segment
+		"crypt" + "\x00\x00\x00\x00\x01\x00\x00\x00" + "dynamic" + "\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"aes-xts-plain64" + "\x00\x00\x02\x00" +
+		// backup-final segment
+		"crypt" + "\x00\x00\x00\x00\x01\x00\x00\x00" + "\x00\x00\x00\x00\x00\x80\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"twofish-xts-plain64" + "\x00\x00\x10\x00"
+	data, err := r.verificationData()
+	require.NoError(t, err)
+	require.Equal(t, []byte(expected), data)
+
+	// decryption uses the old key only
+	r.newDigest = -1
+	d.meta.Segments[3] = segment{Type: SegmentLinear, Offset: "16777216", Size: "dynamic", Flags: []string{segmentFlagBackupFinal}}
+	data, err = r.verificationData()
+	require.NoError(t, err)
+	require.Equal(t, "v2\x01\x02", string(data[:4]))
+	require.True(t, bytes.HasSuffix(data, []byte("linear"+"\x00\x00\x00\x00\x01\x00\x00\x00"+"dynamic")))
+
+	delete(d.meta.Segments, 2)
+	_, err = r.verificationData()
+	require.Error(t, err)
+}
+
+// runReencryptRecoveryTest simulates a crash in the middle of hotzone reencryption
+func runReencryptRecoveryTest(t *testing.T, resilience string) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	opts := &ReencryptOptions{Resilience: resilience, SectorSize: 4096, HotzoneSize: 2 * 1024 * 1024}
+	require.Equal(t, errStopReencryption, Reencrypt(dev, []byte(password), opts, stopAfter(1)))
+
+	// the hotzone is rewritten partially
+	r, err := dev.(*deviceV2).openReencryption()
+	require.NoError(t, err)
+	require.NoError(t, r.load([]byte(password)))
+	require.Equal(t, uint64(2*1024*1024), r.offset)
+	require.NoError(t, r.beginHotzone(r.hotzoneSize))
+	buf := make([]byte, r.hotzoneSize/2+4096)
+	_, err = r.oldData.ReadAt(buf, int64(r.offset))
+	require.NoError(t, err)
+	require.NoError(t, r.writeData(buf, r.offset))
+	r.close()
+	require.NoError(t, dev.Close())
+
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	seg := dev.(*deviceV2).meta.Segments[1]
+	require.Equal(t, []string{segmentFlagInReencryption}, seg.Flags)
+
+	err = Reencrypt(dev, []byte(password), nil, nil)
+	if resilience == ResilienceNone {
+		require.Error(t, err)
+		return
+	}
+	require.NoError(t, err)
+	checkReencryptedDisk(t, disk.Name(), password, data)
+}
+
+func TestReencryptRecoveryChecksum(t *testing.T) {
+	runReencryptRecoveryTest(t, ResilienceChecksum)
+}
+
+func TestReencryptRecoveryJournal(t *testing.T) {
+	runReencryptRecoveryTest(t, ResilienceJournal)
+}
+
+func TestReencryptRecoveryNone(t *testing.T) {
+	runReencryptRecoveryTest(t, ResilienceNone)
+}
+
+func TestReencryptKeyslotsAndTokens(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	_, err = dev.AddKey([]byte(password), []byte("otherpassword"), &testKdf)
+	require.NoError(t, err)
+	d := dev.(*deviceV2)
+	d.meta.Tokens[0] = json.RawMessage(`{"type":"clevis","keyslots":["0"],"jwe":{}}`)
+	d.meta.Tokens[1] = json.RawMessage(`{"type":"systemd-tpm2","keyslots":["1"]}`)
+	require.NoError(t, d.writeHeaders(disk))
+
+	require.NoError(t, Reencrypt(dev, []byte(password), &ReencryptOptions{Resilience: ResilienceNone}, nil))
+	require.Equal(t, []int{2}, dev.Slots())
+
+	// keyslots of the old key are removed
+	_, _, err = unsealAny(dev, []byte("otherpassword"))
+	require.Equal(t, ErrPassphraseDoesNotMatch, err)
+
+	tokens, err := dev.Tokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	for _, tk := range tokens {
+		switch tk.Type {
+		case "clevis":
+			require.Equal(t, []int{2}, tk.Slots)
+		case "systemd-tpm2":
+			require.Empty(t, tk.Slots)
+		}
+	}
+
+	checkReencryptedDisk(t, disk.Name(), password, data)
+}
+
+func TestReencryptInvalid(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	require.Error(t, Reencrypt(dev, []byte(password), nil, nil))
+	require.NoError(t, dev.Close())
+
+	disk, _ = prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+
+	require.Equal(t, ErrPassphraseDoesNotMatch, Reencrypt(dev, []byte("wrongpassword"), nil, nil))
+	for _, opts := range []*ReencryptOptions{
+		{Cipher: "foo-xts-plain64"},
+		{KeySize: 100},
+		{SectorSize: 1000},
+		{Resilience: "foo"},
+		{Hash: "foo"},
+		{HotzoneSize: 100},
+	} {
+		require.Error(t, Reencrypt(dev, []byte(password), opts, nil), "%+v", opts)
+	}
+}
+
+func TestReencryptCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, _ := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	defer dev.Close()
+	require.NoError(t, Reencrypt(dev, []byte(password), nil, nil))
+
+	dumpCmd := exec.Command("cryptsetup", "luksDump", disk.Name())
+	if testing.Verbose() {
+		dumpCmd.Stdout = os.Stdout
+		dumpCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, dumpCmd.Run())
+
+	openCmd := exec.Command("cryptsetup", "open", "--test-passphrase", disk.Name())
+	openCmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		openCmd.Stdout = os.Stdout
+		openCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, openCmd.Run())
+}
+
+func TestReencryptResumeCryptsetup(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, data := prepareReencryptDisk(t, password, &FormatOptions{KDF: testKdf})
+	dev, err := Open(disk.Name())
+	require.NoError(t, err)
+	opts := &ReencryptOptions{Cipher: "twofish-xts-plain64", HotzoneSize: 1024 * 1024}
+	require.Equal(t, errStopReencryption, Reencrypt(dev, []byte(password), opts, stopAfter(3)))
+	require.NoError(t, dev.Close())
+
+	// cryptsetup verifies the reencryption metadata digest before it resumes
+	resumeCmd := exec.Command("cryptsetup", "reencrypt", "--resume-only", disk.Name())
+	resumeCmd.Stdin = strings.NewReader(password)
+	if testing.Verbose() {
+		resumeCmd.Stdout = os.Stdout
+		resumeCmd.Stderr = os.Stderr
+	}
+	require.NoError(t, resumeCmd.Run())
+
+	v := checkReencryptedDisk(t, disk.Name(), password, data)
+	require.Equal(t, "twofish-xts-plain64", v.StorageEncryption)
+}
@@ -0,0 +1,181 @@
+package luks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Serpent block cipher compatible with the Linux kernel "serpent" implementation used by dm-crypt
+// (little-endian byte order of blocks and keys). S-boxes are computed in bitslice mode from their
+// tables, see "Serpent: A Proposal for the Advanced Encryption Standard" by Anderson, Biham and Knudsen.
+
+const (
+	serpentBlockSize  = 16
+	serpentMaxKeySize = 32
+	serpentRounds     = 32
+	serpentPhi        = 0x9e3779b9
+)
+
+var serpentSbox = [8][16]uint8{
+	{3, 8, 15, 1, 10, 6, 5, 11, 14, 13, 4, 2, 7, 0, 9, 12},
+	{15, 12, 2, 7, 9, 0, 5, 10, 1, 11, 14, 8, 6, 13, 3, 4},
+	{8, 6, 7, 9, 3, 12, 10, 15, 13, 1, 14, 4, 0, 11, 5, 2},
+	{0, 15, 11, 8, 12, 9, 6, 3, 13, 1, 2, 4, 10, 7, 5, 14},
+	{1, 15, 8, 3, 12, 0, 11, 6, 2, 5, 4, 10, 9, 14, 7, 13},
+	{15, 5, 2, 11, 4, 10, 9, 12, 0, 3, 14, 8, 13, 6, 7, 1},
+	{7, 2, 12, 5, 8, 4, 6, 11, 14, 9, 1, 15, 13, 3, 10, 0},
+	{1, 13, 15, 0, 14, 8, 2, 11, 7, 4, 12, 10, 9, 3, 5, 6},
+}
+
+var serpentSboxInv [8][16]uint8
+
+func init() {
+	for i, s := range serpentSbox {
+		for x, y := range s {
+			serpentSboxInv[i][y] = uint8(x)
+		}
+	}
+}
+
+type serpentCipher struct {
+	subkeys [serpentRounds + 1][4]uint32
+}
+
+// newSerpentCipher creates a Serpent cipher, the key length is up to 256 bits
+func newSerpentCipher(key []byte) (cipher.Block, error) {
+	if len(key) == 0 || len(key) > serpentMaxKeySize {
+		return nil, fmt.Errorf("invalid serpent key size %d", len(key))
+	}
+
+	// short keys are padded with a single '1' bit followed by zeros
+	var k [serpentMaxKeySize]byte
+	copy(k[:], key)
+	if len(key) < serpentMaxKeySize {
+		k[len(key)] = 1
+	}
+
+	var w [8 + 4*(serpentRounds+1)]uint32
+	for i := 0; i < 8; i++ {
+		w[i] = binary.LittleEndian.Uint32(k[4*i:])
+	}
+	for i := 8; i < len(w); i++ {
+		w[i] = bits.RotateLeft32(w[i-8]^w[i-5]^w[i-3]^w[i-1]^serpentPhi^uint32(i-8), 11)
+	}
+
+	c := &serpentCipher{}
+	for i := range c.subkeys {
+		x := [4]uint32{w[8+4*i], w[9+4*i], w[10+4*i], w[11+4*i]}
+		c.subkeys[i] = serpentSubstitute(&serpentSbox[(3-i)&7], x)
+	}
+	return c, nil
+}
+
+func (c *serpentCipher) BlockSize() int {
+	return serpentBlockSize
+}
+
+func (c *serpentCipher) Encrypt(dst, src []byte) {
+	x := serpentLoad(src)
+	for i := 0; i < serpentRounds; i++ {
+		serpentXorKey(&x, c.subkeys[i])
+		x = serpentSubstitute(&serpentSbox[i&7], x)
+		if i == serpentRounds-1 {
+			serpentXorKey(&x, c.subkeys[serpentRounds])
+		} else {
+			serpentLinearTransform(&x)
+		}
+	}
+	serpentStore(dst, x)
+}
+
+func (c *serpentCipher) Decrypt(dst, src []byte) {
+	x := serpentLoad(src)
+	for i := serpentRounds - 1; i >= 0; i-- {
+		if i == serpentRounds-1 {
+			serpentXorKey(&x, c.subkeys[serpentRounds])
+		} else {
+			serpentInverseLinearTransform(&x)
+		}
+		x = serpentSubstitute(&serpentSboxInv[i&7], x)
+		serpentXorKey(&x, c.subkeys[i])
+	}
+	serpentStore(dst, x)
+}
+
+func serpentLoad(src []byte) [4]uint32 {
+	return [4]uint32{
+		binary.LittleEndian.Uint32(src[0:]),
+		binary.LittleEndian.Uint32(src[4:]),
+		binary.LittleEndian.Uint32(src[8:]),
+		binary.LittleEndian.Uint32(src[12:]),
+	}
+}
+
+func serpentStore(dst []byte, x [4]uint32) {
+	binary.LittleEndian.PutUint32(dst[0:], x[0])
+	binary.LittleEndian.PutUint32(dst[4:], x[1])
+	binary.LittleEndian.PutUint32(dst[8:], x[2])
+	binary.LittleEndian.PutUint32(dst[12:], x[3])
+}
+
+func serpentXorKey(x *[4]uint32, k [4]uint32) {
+	x[0] ^= k[0]
+	x[1] ^= k[1]
+	x[2] ^= k[2]
+	x[3] ^= k[3]
+}
+
+// serpentSubstitute applies the S-box to 32 4-bit columns of x in parallel. Bit j of x[0] is the least significant bit
+// of the j-th column input. Every output bit is computed as a disjunction of the input minterms from the S-box table.
+func serpentSubstitute(sbox *[16]uint8, x [4]uint32) [4]uint32 {
+	var minterms [16]uint32
+	for v := range minterms {
+		m := ^uint32(0)
+		for b := 0; b < 4; b++ {
+			if v&(1<<b) != 0 {
+				m &= x[b]
+			} else {
+				m &= ^x[b]
+			}
+		}
+		minterms[v] = m
+	}
+
+	var y [4]uint32
+	for v, out := range sbox {
+		for b := 0; b < 4; b++ {
+			if out&(1<<b) != 0 {
+				y[b] |= minterms[v]
+			}
+		}
+	}
+	return y
+}
+
+func serpentLinearTransform(x *[4]uint32) {
+	x[0] = bits.RotateLeft32(x[0], 13)
+	x[2] = bits.RotateLeft32(x[2], 3)
+	x[1] ^= x[0] ^ x[2]
+	x[3] ^= x[2] ^ (x[0] << 3)
+	x[1] = bits.RotateLeft32(x[1], 1)
+	x[3] = bits.RotateLeft32(x[3], 7)
+	x[0] ^= x[1] ^ x[3]
+	x[2] ^= x[3] ^ (x[1] << 7)
+	x[0] = bits.RotateLeft32(x[0], 5)
+	x[2] = bits.RotateLeft32(x[2], 22)
+}
+
+func serpentInverseLinearTransform(x *[4]uint32) {
+	x[2] = bits.RotateLeft32(x[2], -22)
+	x[0] = bits.RotateLeft32(x[0], -5)
+	x[2] ^= x[3] ^ (x[1] << 7)
+	x[0] ^= x[1] ^ x[3]
+	x[3] = bits.RotateLeft32(x[3], -7)
+	x[1] = bits.RotateLeft32(x[1], -1)
+	x[3] ^= x[2] ^ (x[0] << 3)
+	x[1] ^= x[0] ^ x[2]
+	x[2] = bits.RotateLeft32(x[2], -3)
+	x[0] = bits.RotateLeft32(x[0], -13)
+}
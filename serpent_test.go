@@ -0,0 +1,45 @@
+package luks
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerpentVectors(t *testing.T) {
+	// vectors from Linux kernel crypto/testmgr.h and NESSIE
+	vectors := []struct {
+		key, plaintext, ciphertext string
+	}{
+		{"000102030405060708090a0b0c0d0e0f", "000102030405060708090a0b0c0d0e0f", "4c7d8a328072a22c823e4a1f3acda16d"},
+		{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f", "000102030405060708090a0b0c0d0e0f", "de269ff833e432b85b2e88d2701ce75c"},
+		{"80000000000000000000000000000000", "00000000000000000000000000000000", "264e5481eff42a4606abda06c0bfda3d"},
+		{"00000000000000000000000000000080", "00000000000000000000000000000000", "ddd26b98a5ffd82c05345a9dadbfaf49"},
+	}
+
+	for _, v := range vectors {
+		key, err := hex.DecodeString(v.key)
+		require.NoError(t, err)
+		plaintext, err := hex.DecodeString(v.plaintext)
+		require.NoError(t, err)
+
+		c, err := newSerpentCipher(key)
+		require.NoError(t, err)
+		require.Equal(t, 16, c.BlockSize())
+
+		buf := make([]byte, 16)
+		c.Encrypt(buf, plaintext)
+		require.Equal(t, v.ciphertext, hex.EncodeToString(buf))
+
+		c.Decrypt(buf, buf)
+		require.Equal(t, plaintext, buf)
+	}
+}
+
+func TestSerpentInvalidKey(t *testing.T) {
+	_, err := newSerpentCipher(nil)
+	require.Error(t, err)
+	_, err = newSerpentCipher(make([]byte, 33))
+	require.Error(t, err)
+}
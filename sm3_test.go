@@ -0,0 +1,16 @@
+package luks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSM3Vectors(t *testing.T) {
+	// examples from GB/T 32905-2016 appendix A
+	checkHashVector(t, newSM3, []byte("abc"), "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0")
+	checkHashVector(t, newSM3, []byte(strings.Repeat("abcd", 16)), "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732")
+
+	// the padding does not fit into the last block
+	checkHashVector(t, newSM3, []byte(strings.Repeat("a", 56)), "ba00ebedaab54065a5fd4f9f56326016203166bcee3eed44ea868d59d67aa3c8")
+	checkHashVector(t, newSM3, []byte(strings.Repeat("a", 1000)), "f4bedca973227d45c5b822551d2e762d4cfb0e9af70b241452545727b5fb046f")
+}
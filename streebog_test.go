@@ -0,0 +1,35 @@
+package luks
+
+import (
+	"encoding/hex"
+	"hash"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func checkHashVector(t *testing.T, h func() hash.Hash, msg []byte, expected string) {
+	d := h()
+	d.Write(msg)
+	require.Equal(t, expected, hex.EncodeToString(d.Sum(nil)))
+
+	// writing the message in small chunks gives the same result
+	d.Reset()
+	for i := 0; i < len(msg); i += 7 {
+		d.Write(msg[i:min(i+7, len(msg))])
+	}
+	require.Equal(t, expected, hex.EncodeToString(d.Sum(nil)))
+}
+
+func TestStreebogVectors(t *testing.T) {
+	// examples from GOST R 34.11-2012, see also RFC 6986
+	m1 := []byte("012345678901234567890123456789012345678901234567890123456789012")
+	// "Се ветри, Стрибожи внуци, веютъ с моря стрелами на храбрыя плъкы Игоревы" in windows-1251 encoding
+	m2, err := hex.DecodeString("d1e520e2e5f2f0e82c20d1f2f0e8e1eee6e820e2edf3f6e82c20e2e5fef2fa20f120eceef0ff20f1f2f0e5ebe0ece820ede020f5f0e0e1f0fbff20efebfaeafb20c8e3eef0e5e2fb")
+	require.NoError(t, err)
+
+	checkHashVector(t, newStreebog512, m1, "1b54d01a4af5b9d5cc3d86d68d285462b19abc2475222f35c085122be4ba1ffa00ad30f8767b3a82384c6574f024c311e2a481332b08ef7f41797891c1646f48")
+	checkHashVector(t, newStreebog256, m1, "9d151eefd8590b89daa6ba6cb74af9275dd051026bb149a452fd84e5e57b5500")
+	checkHashVector(t, newStreebog512, m2, "1e88e62226bfca6f9994f1f2d51569e0daf8475a3b0fe61a5300eee46d961376035fe83549ada2b8620fcd7c496ce5b33f0cb9dddc2b6460143b03dabac9fb28")
+	checkHashVector(t, newStreebog256, m2, "9dd2fe4e90409e5da87f53976d7405b0c0cac628fc669a741d50063c557e8f50")
+}
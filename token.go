@@ -0,0 +1,126 @@
+package luks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNoUsableToken is an error that indicates none of the device tokens unlocked a keyslot
+var ErrNoUsableToken = fmt.Errorf("No token unlocked the device")
+
+// TokenHandler recovers keyslot passphrases from tokens of a specific type e.g. "clevis" or "systemd-fido2".
+// Handlers are registered with RegisterTokenHandler and used by Device.UnlockWithTokens.
+type TokenHandler interface {
+	// Type returns the token type handled by this handler, it is matched against Token.Type
+	Type() string
+	// Unlock returns the passphrase of the keyslots the token refers to. Note that the payload of a LUKS1 token
+	// is the raw luksmeta slot data while LUKS2 token payload is the token JSON object.
+	Unlock(ctx context.Context, token Token) (passphrase []byte, err error)
+}
+
+var (
+	tokenHandlersMu sync.RWMutex
+	tokenHandlers   = make(map[string]TokenHandler)
+)
+
+// RegisterTokenHandler makes the handler available for tokens of its type.
+// It panics if the handler is nil or a handler for the same type is registered already.
+func RegisterTokenHandler(h TokenHandler) {
+	if h == nil {
+		panic("luks: RegisterTokenHandler handler is nil")
+	}
+
+	tokenHandlersMu.Lock()
+	defer tokenHandlersMu.Unlock()
+
+	typ := h.Type()
+	if _, dup := tokenHandlers[typ]; dup {
+		panic("luks: RegisterTokenHandler called twice for token type " + typ)
+	}
+	tokenHandlers[typ] = h
+}
+
+func lookupTokenHandler(typ string) TokenHandler {
+	tokenHandlersMu.RLock()
+	defer tokenHandlersMu.RUnlock()
+	return tokenHandlers[typ]
+}
+
+// unsealWithTokens tries tokens that have a registered handler in the order of their ids. The passphrase recovered
+// by a token is tried against the token keyslots in priority order. It returns the unsealed volume together with
+// the keyslot id.
+func unsealWithTokens(ctx context.Context, d Device) (*Volume, int, error) {
+	tokens, err := d.Tokens()
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+
+	var failures []string
+	for _, t := range tokens {
+		h := lookupTokenHandler(t.Type)
+		if h == nil {
+			continue
+		}
+
+		// active keyslots of the token ordered by priority
+		var slots []int
+		for _, s := range d.Slots() {
+			for _, ts := range t.Slots {
+				if s == ts {
+					slots = append(slots, s)
+					break
+				}
+			}
+		}
+		if len(slots) == 0 {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		passphrase, err := h.Unlock(ctx, t)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, 0, ctxErr
+			}
+			failures = append(failures, fmt.Sprintf("token %d: %v", t.ID, err))
+			continue
+		}
+
+		for _, s := range slots {
+			volume, err := d.UnsealVolume(s, passphrase)
+			if err == ErrPassphraseDoesNotMatch {
+				continue
+			} else if err != nil {
+				clearSlice(passphrase)
+				return nil, 0, err
+			}
+
+			clearSlice(passphrase)
+			return volume, s, nil
+		}
+		clearSlice(passphrase)
+		failures = append(failures, fmt.Sprintf("token %d: %v", t.ID, ErrPassphraseDoesNotMatch))
+	}
+
+	if len(failures) != 0 {
+		return nil, 0, fmt.Errorf("%w: %v", ErrNoUsableToken, strings.Join(failures, "; "))
+	}
+	return nil, 0, ErrNoUsableToken
+}
+
+// unlockWithTokens is a shared implementation of Device.UnlockWithTokens
+func unlockWithTokens(ctx context.Context, d Device, dmName string) error {
+	volume, _, err := unsealWithTokens(ctx, d)
+	if err != nil {
+		return err
+	}
+	defer clearSlice(volume.key)
+
+	return volume.SetupMapper(dmName)
+}
@@ -0,0 +1,157 @@
+package luks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testTokenHandler returns passphrases stored for token ids and records the tokens it was asked to unlock
+type testTokenHandler struct {
+	typ         string
+	passphrases map[int]string
+
+	mu    sync.Mutex
+	calls []int
+}
+
+func (h *testTokenHandler) Type() string {
+	return h.typ
+}
+
+func (h *testTokenHandler) Unlock(ctx context.Context, token Token) ([]byte, error) {
+	h.mu.Lock()
+	h.calls = append(h.calls, token.ID)
+	h.mu.Unlock()
+
+	p, ok := h.passphrases[token.ID]
+	if !ok {
+		return nil, fmt.Errorf("device is not available")
+	}
+	return []byte(p), nil
+}
+
+// registerTestTokenHandler registers the handler for the duration of the test
+func registerTestTokenHandler(t *testing.T, h *testTokenHandler) {
+	RegisterTokenHandler(h)
+	t.Cleanup(func() {
+		tokenHandlersMu.Lock()
+		delete(tokenHandlers, h.typ)
+		tokenHandlersMu.Unlock()
+	})
+}
+
+func TestUnsealWithTokens(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+	for i := 1; i <= 2; i++ {
+		_, err = dev.AddKey([]byte(password), []byte(fmt.Sprintf("password%d", i)), &testKdf)
+		require.NoError(t, err)
+	}
+
+	h := &testTokenHandler{
+		typ: "test-unseal",
+		passphrases: map[int]string{
+			1: "wrongpassword",
+			3: "password1",
+			4: "password2",
+		},
+	}
+	registerTestTokenHandler(t, h)
+
+	for _, token := range []Token{
+		{ID: 0, Slots: []int{0}, Type: "test-unregistered"},
+		{ID: 1, Slots: []int{0}, Type: h.typ},
+		{ID: 2, Slots: []int{0, 1}, Type: h.typ},
+		{ID: 3, Slots: []int{2, 1}, Type: h.typ},
+		{ID: 4, Slots: []int{2}, Type: h.typ},
+	} {
+		_, err := dev.TokenImport(token)
+		require.NoError(t, err)
+	}
+
+	v, slot, err := unsealWithTokens(context.Background(), dev)
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	// token 3 keyslots are tried in the priority order
+	require.Equal(t, 1, slot)
+	require.Equal(t, []int{1, 2, 3}, h.calls)
+
+	// keyslots with "ignore" priority are not used
+	d := dev.(*deviceV2)
+	prio := 0
+	ks := d.meta.Keyslots[1]
+	ks.Priority = &prio
+	d.meta.Keyslots[1] = ks
+	h.calls = nil
+	_, slot, err = unsealWithTokens(context.Background(), dev)
+	require.NoError(t, err)
+	require.Equal(t, 2, slot)
+	require.Equal(t, []int{1, 2, 3, 4}, h.calls)
+
+	require.NoError(t, dev.TokenRemove(3))
+	require.NoError(t, dev.TokenRemove(4))
+	_, _, err = unsealWithTokens(context.Background(), dev)
+	require.ErrorIs(t, err, ErrNoUsableToken)
+	require.ErrorContains(t, err, "token 1: "+ErrPassphraseDoesNotMatch.Error())
+	require.ErrorContains(t, err, "token 2: device is not available")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = unsealWithTokens(ctx, dev)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestUnsealWithTokensLuks1(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 4*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{Version: 1, KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+	_, err = dev.AddKey([]byte(password), []byte("password1"), &testKdf)
+	require.NoError(t, err)
+
+	h := &testTokenHandler{typ: "clevis", passphrases: map[int]string{1: "password1"}}
+	registerTestTokenHandler(t, h)
+	_, err = dev.TokenImport(Token{ID: -1, Slots: []int{1}, Type: "clevis", Payload: []byte("jwe")})
+	require.NoError(t, err)
+
+	v, slot, err := unsealWithTokens(context.Background(), dev)
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	require.Equal(t, 1, slot)
+}
+
+func TestUnlockWithTokensNoTokens(t *testing.T) {
+	t.Parallel()
+
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte("foobar"), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	defer dev.Close()
+
+	err = dev.UnlockWithTokens(context.Background(), "luks-go-no-tokens")
+	require.True(t, errors.Is(err, ErrNoUsableToken))
+}
+
+func TestRegisterTokenHandler(t *testing.T) {
+	t.Parallel()
+
+	registerTestTokenHandler(t, &testTokenHandler{typ: "test-register"})
+	require.NotNil(t, lookupTokenHandler("test-register"))
+	require.Nil(t, lookupTokenHandler("test-missing"))
+
+	require.Panics(t, func() { RegisterTokenHandler(&testTokenHandler{typ: "test-register"}) })
+	require.Panics(t, func() { RegisterTokenHandler(nil) })
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
 	"fmt"
 	"hash"
+	"io"
 	"os"
 	"syscall"
 
@@ -47,6 +49,18 @@ func fileSize(f *os.File) (uint64, error) {
 	return uint64(sz), err
 }
 
+// readerSize returns size of the storage
+func readerSize(r io.ReaderAt) (uint64, error) {
+	switch s := r.(type) {
+	case *os.File:
+		return fileSize(s)
+	case interface{ Size() int64 }:
+		return uint64(s.Size()), nil
+	default:
+		return 0, fmt.Errorf("unable to get size of %T", r)
+	}
+}
+
 func isPowerOfTwo(x uint) bool {
 	return (x & (x - 1)) == 0
 }
@@ -63,6 +77,92 @@ func fixedArrayToString(buff []byte) string {
 	return string(buff)
 }
 
+// generateUUID returns a random (version 4) UUID string
+func generateUUID() (string, error) {
+	u := make([]byte, 16)
+	if _, err := rand.Read(u); err != nil {
+		return "", err
+	}
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant is 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+// isValidUUID checks that the string is a UUID in its canonical textual form
+func isValidUUID(uuid string) bool {
+	if len(uuid) != 36 {
+		return false
+	}
+	for i, c := range []byte(uuid) {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return false
+			}
+			continue
+		}
+		isHex := (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+		if !isHex {
+			return false
+		}
+	}
+	return true
+}
+
+// memWriterAt is an io.WriterAt backed by a byte slice, it is used to prepare a region before writing it at once
+type memWriterAt []byte
+
+func (m memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m)) {
+		return 0, fmt.Errorf("write of %d bytes at offset %d is out of buffer of size %d", len(p), off, len(m))
+	}
+	return copy(m[off:], p), nil
+}
+
+// wipeArea overwrites the given region of w with random data
+func wipeArea(w io.WriterAt, offset, size int64) error {
+	const chunkSize = 1024 * 1024
+	buf := make([]byte, chunkSize)
+	for size > 0 {
+		n := int64(chunkSize)
+		if size < n {
+			n = size
+		}
+		if _, err := rand.Read(buf[:n]); err != nil {
+			return err
+		}
+		if _, err := w.WriteAt(buf[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		size -= n
+	}
+	return nil
+}
+
+// isZeroArea reports whether the given region of r contains only zero bytes
+func isZeroArea(r io.ReaderAt, offset, size int64) (bool, error) {
+	const chunkSize = 1024 * 1024
+	buf := make([]byte, chunkSize)
+	for size > 0 {
+		n := int64(chunkSize)
+		if size < n {
+			n = size
+		}
+		if _, err := r.ReadAt(buf[:n], offset); err != nil {
+			return false, err
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += n
+		size -= n
+	}
+	return true, nil
+}
+
 func clearSlice(slice []byte) {
 	for i := range slice {
 		slice[i] = 0
@@ -72,9 +172,6 @@ func clearSlice(slice []byte) {
 // getHashAlgo gets hash implementation and the hash size by its name
 // If hash is not found then it returns nil as a first argument
 func getHashAlgo(name string) (func() hash.Hash, int) {
-	// Note that cryptsetup support a few more hash algorithms not implemented here: stribog256, stribog512, sm3
-	// golang lib does not implement those
-	// TODO use third-party implementations for other hashes and add its support to luks.go
 	switch name {
 	case "sha1":
 		return sha1.New, sha1.Size
@@ -109,6 +206,13 @@ func getHashAlgo(name string) (func() hash.Hash, int) {
 		return blake2s256Constructor()
 	case "whirlpool":
 		return whirlpool.New, 512 / 8
+	case "stribog256", "streebog256":
+		// cryptsetup gcrypt backend uses "stribog" name while the kernel crypto API calls it "streebog"
+		return newStreebog256, 256 / 8
+	case "stribog512", "streebog512":
+		return newStreebog512, 512 / 8
+	case "sm3":
+		return newSM3, sm3Size
 	default:
 		return nil, 0
 	}
@@ -126,6 +230,8 @@ func getCipher(name string) (func(key []byte) (cipher.Block, error), error) {
 			return twofish.NewCipher(key)
 		}
 		return f, nil
+	case "serpent":
+		return newSerpentCipher, nil
 	default:
 		return nil, fmt.Errorf("Unknown cipher: %v", name)
 	}
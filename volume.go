@@ -2,6 +2,8 @@ package luks
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/anatol/devmapper.go"
@@ -9,7 +11,7 @@ import (
 
 // Volume represents information provided by an unsealed (i.e. with recovered password) LUKS slot
 type Volume struct {
-	BackingDevice     string
+	BackingDevice     string   // empty if the device is opened with OpenReaderAt
 	Flags             []string // luks-named flags
 	UUID              string
 	key               []byte // keep decoded key field private for security reasons
@@ -17,8 +19,51 @@ type Volume struct {
 	StorageEncryption string
 	StorageIvTweak    uint64
 	StorageSectorSize uint64
-	StorageOffset     uint64 // offset of underlying storage in bytes
-	StorageSize       uint64 // length of underlying device in bytes, zero means that size should be calculated using `diskSize` function
+	StorageOffset     uint64          // offset of underlying storage in bytes
+	StorageSize       uint64          // length of underlying device in bytes, zero means that size should be calculated using `diskSize` function
+	Segments          []VolumeSegment // all data segments in the mapping order if the volume consists of several segments, Storage* fields describe the first one
+	backing           io.ReaderAt     // storage of the device the volume was unsealed from
+}
+
+// Types of the volume segments
+const (
+	SegmentCrypt  = "crypt"  // data encrypted with the volume key
+	SegmentLinear = "linear" // unencrypted data
+)
+
+// VolumeSegment is a contiguous range of the volume data. LUKS2 volumes might consist of several segments,
+// e.g. when reencryption is in progress or when the device has unencrypted holes.
+type VolumeSegment struct {
+	Type       string // SegmentCrypt or SegmentLinear
+	Encryption string // empty for linear segments
+	IvTweak    uint64
+	SectorSize uint64
+	Offset     uint64 // offset of the segment data in the underlying storage in bytes
+	Size       uint64 // length of the segment in bytes
+}
+
+// segments returns the volume segments, a single-segment volume is described by Storage* fields
+func (v *Volume) segments() []VolumeSegment {
+	if len(v.Segments) != 0 {
+		return v.Segments
+	}
+	return []VolumeSegment{{
+		Type:       SegmentCrypt,
+		Encryption: v.StorageEncryption,
+		IvTweak:    v.StorageIvTweak,
+		SectorSize: v.StorageSectorSize,
+		Offset:     v.StorageOffset,
+		Size:       v.StorageSize,
+	}}
+}
+
+// size returns the length of the volume data in bytes
+func (v *Volume) size() uint64 {
+	var size uint64
+	for _, s := range v.segments() {
+		size += s.Size
+	}
+	return size
 }
 
 // map of LUKS flag names to its dm-crypt counterparts
@@ -32,6 +77,10 @@ var flagsKernelNames = map[string]string{
 
 // SetupMapper creates a device mapper for the given LUKS volume
 func (v *Volume) SetupMapper(name string) error {
+	if v.BackingDevice == "" {
+		return fmt.Errorf("volume does not have a backing device path, it cannot be mapped")
+	}
+
 	kernelFlags := make([]string, 0, len(v.Flags))
 	for _, f := range v.Flags {
 		flag, ok := flagsKernelNames[f]
@@ -41,26 +90,339 @@ func (v *Volume) SetupMapper(name string) error {
 		kernelFlags = append(kernelFlags, flag)
 	}
 
-	if v.StorageSize%v.StorageSectorSize != 0 {
-		return fmt.Errorf("storage size must be multiple of sector size")
+	tables, err := v.mapperTables(kernelFlags)
+	if err != nil {
+		return err
 	}
-	if v.StorageOffset%v.StorageSectorSize != 0 {
-		return fmt.Errorf("offset must be multiple of sector size")
+
+	uuid := fmt.Sprintf("CRYPT-%v-%v-%v", v.LuksType, strings.ReplaceAll(v.UUID, "-", ""), name) // See dm_prepare_uuid()
+
+	return devmapper.CreateAndLoad(name, uuid, 0, tables...)
+}
+
+// mapperTables returns device mapper targets for all volume segments, the segments are mapped one after another
+func (v *Volume) mapperTables(kernelFlags []string) ([]devmapper.Table, error) {
+	segments := v.segments()
+	tables := make([]devmapper.Table, 0, len(segments))
+	var start uint64
+	for i, s := range segments {
+		switch s.Type {
+		case SegmentLinear:
+			if s.Size%storageSectorSize != 0 || s.Offset%storageSectorSize != 0 {
+				return nil, fmt.Errorf("segment %d: size and offset must be multiple of %d bytes", i, storageSectorSize)
+			}
+			tables = append(tables, devmapper.LinearTable{
+				Start:         start,
+				Length:        s.Size,
+				BackendDevice: v.BackingDevice,
+				BackendOffset: s.Offset,
+			})
+		case SegmentCrypt:
+			if s.SectorSize == 0 || s.Size%s.SectorSize != 0 {
+				return nil, fmt.Errorf("storage size must be multiple of sector size")
+			}
+			if s.Offset%s.SectorSize != 0 {
+				return nil, fmt.Errorf("offset must be multiple of sector size")
+			}
+			tables = append(tables, devmapper.CryptTable{
+				Start:         start,
+				Length:        s.Size,
+				BackendDevice: v.BackingDevice,
+				BackendOffset: s.Offset,
+				Encryption:    s.Encryption,
+				Key:           v.key,
+				IVTweak:       s.IvTweak,
+				Flags:         kernelFlags,
+				SectorSize:    s.SectorSize,
+			})
+		default:
+			return nil, fmt.Errorf("segment %d: unknown segment type %v", i, s.Type)
+		}
+		start += s.Size
 	}
+	return tables, nil
+}
 
-	table := devmapper.CryptTable{
-		Start:         0,
-		Length:        v.StorageSize,
-		BackendDevice: v.BackingDevice,
-		BackendOffset: v.StorageOffset,
-		Encryption:    v.StorageEncryption,
-		Key:           v.key,
-		IVTweak:       v.StorageIvTweak,
-		Flags:         kernelFlags,
-		SectorSize:    v.StorageSectorSize,
+// NewReaderAt returns a reader that decrypts the volume data in userspace, it does not require device mapper
+// thus it works for unprivileged users. Offsets are relative to the beginning of the decrypted data.
+// The reader uses storage of the LUKS device the volume was unsealed from, and it is valid until the device is closed.
+// Similar to dm-crypt, a partial sector at the end of the storage is not a part of the volume data.
+func (v *Volume) NewReaderAt() (io.ReaderAt, error) {
+	r, _, err := v.newReaderAt()
+	return r, err
+}
+
+// newReaderAt returns the volume reader together with the size of the readable data
+func (v *Volume) newReaderAt() (io.ReaderAt, int64, error) {
+	if v.backing == nil {
+		return nil, 0, fmt.Errorf("volume does not have a backing storage")
+	}
+	segments, err := v.newSegmentReaders(v.backing)
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	for _, s := range segments {
+		size += s.size
 	}
+	if len(segments) == 1 {
+		return segments[0], size, nil
+	}
+	return segmentedReader(segments), size, nil
+}
 
-	uuid := fmt.Sprintf("CRYPT-%v-%v-%v", v.LuksType, strings.ReplaceAll(v.UUID, "-", ""), name) // See dm_prepare_uuid()
+// newSegmentReaders creates a reader for every volume segment, linear segments are read as is
+func (v *Volume) newSegmentReaders(backing io.ReaderAt) ([]*volumeReader, error) {
+	segments := v.segments()
+	readers := make([]*volumeReader, len(segments))
+	for i, s := range segments {
+		r, err := newVolumeReader(backing, s, v.key)
+		if err != nil {
+			return nil, err
+		}
+		readers[i] = r
+	}
+	// dm-crypt maps only whole sectors
+	last := readers[len(readers)-1]
+	last.size -= last.size % last.sectorSize
+	return readers, nil
+}
+
+func newVolumeReader(backing io.ReaderAt, s VolumeSegment, key []byte) (*volumeReader, error) {
+	if s.Type == SegmentLinear {
+		s.Encryption = "cipher_null"
+		s.SectorSize = storageSectorSize
+	}
+	if s.SectorSize < storageSectorSize || s.SectorSize%storageSectorSize != 0 {
+		return nil, fmt.Errorf("invalid sector size %v", s.SectorSize)
+	}
+	if s.Offset%storageSectorSize != 0 {
+		return nil, fmt.Errorf("offset must be multiple of %d bytes", storageSectorSize)
+	}
+
+	c, err := newSectorCipher(s.Encryption, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &volumeReader{
+		backing:    backing,
+		cipher:     c,
+		offset:     int64(s.Offset),
+		size:       int64(s.Size),
+		sectorSize: int64(s.SectorSize),
+		ivTweak:    s.IvTweak,
+	}, nil
+}
+
+// NewReader returns a seekable reader of the decrypted volume data, see NewReaderAt
+func (v *Volume) NewReader() (*io.SectionReader, error) {
+	r, size, err := v.newReaderAt()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(r, 0, size), nil
+}
+
+// segmentedReader reads data of consecutive volume segments
+type segmentedReader []*volumeReader
+
+func (r segmentedReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	n := 0
+	for _, s := range r {
+		if n == len(p) {
+			break
+		}
+		if off >= s.size {
+			off -= s.size
+			continue
+		}
+		m, err := s.ReadAt(p[n:], off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		off = 0
+	}
+	if n != len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// volumeReader decrypts data sector by sector the same way dm-crypt does
+type volumeReader struct {
+	backing    io.ReaderAt
+	cipher     sectorCipher
+	offset     int64 // data offset in the backing storage
+	size       int64
+	sectorSize int64
+	ivTweak    uint64
+}
 
-	return devmapper.CreateAndLoad(name, uuid, 0, table)
+func (r *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	var eof error
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+		eof = io.EOF
+	}
+
+	// read the whole sectors that cover the requested range
+	start := off - off%r.sectorSize
+	end := (off + int64(len(p)) + r.sectorSize - 1) / r.sectorSize * r.sectorSize
+	buf := make([]byte, end-start)
+	if n, err := r.backing.ReadAt(buf, r.offset+start); n != len(buf) {
+		return 0, err
+	}
+
+	r.decrypt(buf, start)
+
+	n := copy(p, buf[off-start:])
+	clearSlice(buf)
+	return n, eof
+}
+
+// decrypt decrypts in-place whole sectors of buf located at the data offset off
+func (r *volumeReader) decrypt(buf []byte, off int64) {
+	for i := int64(0); i < int64(len(buf)); i += r.sectorSize {
+		sector := buf[i : i+r.sectorSize]
+		r.cipher.Decrypt(sector, sector, r.iv(off+i))
+	}
+}
+
+// encrypt encrypts in-place whole sectors of buf located at the data offset off
+func (r *volumeReader) encrypt(buf []byte, off int64) {
+	for i := int64(0); i < int64(len(buf)); i += r.sectorSize {
+		sector := buf[i : i+r.sectorSize]
+		r.cipher.Encrypt(sector, sector, r.iv(off+i))
+	}
+}
+
+// iv returns dm-crypt IV sector number for the data offset.
+// The IV is counted in 512 bytes sectors unless iv_large_sectors is used.
+func (r *volumeReader) iv(off int64) uint64 {
+	return uint64(off)/storageSectorSize + r.ivTweak
+}
+
+// VolumeWriter writes data to the volume storage
+type VolumeWriter interface {
+	io.WriterAt
+	io.Closer
+}
+
+// NewWriterAt opens the backing device for writing and returns a writer that encrypts the volume data
+// in userspace, it does not require device mapper. Offsets are relative to the beginning of the decrypted data.
+// Writes that are not aligned to the sector size read and re-encrypt the partially modified sectors.
+// The volume must have a backing device path i.e. volumes of devices opened with OpenReaderAt cannot be written.
+// Closing the writer flushes the data to the storage.
+func (v *Volume) NewWriterAt() (VolumeWriter, error) {
+	if v.BackingDevice == "" {
+		return nil, fmt.Errorf("volume does not have a backing device path, it cannot be written")
+	}
+
+	f, err := os.OpenFile(v.BackingDevice, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := v.newSegmentReaders(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &volumeWriter{f: f, segments: segments}
+	for _, r := range segments {
+		w.size += r.size
+	}
+	return w, nil
+}
+
+// volumeWriter encrypts data sector by sector the same way dm-crypt does
+type volumeWriter struct {
+	f        *os.File
+	segments []*volumeReader
+	size     int64
+}
+
+func (w *volumeWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= w.size && len(p) > 0 {
+		return 0, fmt.Errorf("write at offset %d is beyond the end of the volume", off)
+	}
+
+	var errShort error
+	if int64(len(p)) > w.size-off {
+		p = p[:w.size-off]
+		errShort = fmt.Errorf("write is beyond the end of the volume")
+	}
+
+	n := 0
+	for _, r := range w.segments {
+		if n == len(p) {
+			break
+		}
+		if off >= r.size {
+			off -= r.size
+			continue
+		}
+		chunk := p[n:]
+		if int64(len(chunk)) > r.size-off {
+			chunk = chunk[:r.size-off]
+		}
+		m, err := w.writeSegment(r, chunk, off)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		off = 0
+	}
+	return n, errShort
+}
+
+// writeSegment encrypts p and writes it at offset off of the segment, the data must fit the segment
+func (w *volumeWriter) writeSegment(r *volumeReader, p []byte, off int64) (int, error) {
+	start := off - off%r.sectorSize
+	end := (off + int64(len(p)) + r.sectorSize - 1) / r.sectorSize * r.sectorSize
+	buf := make([]byte, end-start)
+	defer clearSlice(buf)
+
+	// partially modified sectors need their current content
+	if start != off {
+		if _, err := r.ReadAt(buf[:r.sectorSize], start); err != nil {
+			return 0, err
+		}
+	}
+	if last := end - r.sectorSize; end != off+int64(len(p)) && (last != start || start == off) {
+		// the last sector is read unless it is the same as the first one that has been read already
+		if _, err := r.ReadAt(buf[last-start:], last); err != nil {
+			return 0, err
+		}
+	}
+	copy(buf[off-start:], p)
+	r.encrypt(buf, start)
+
+	if _, err := w.f.WriteAt(buf, r.offset+start); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *volumeWriter) Close() error {
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
 }
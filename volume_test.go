@@ -0,0 +1,365 @@
+package luks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/anatol/devmapper.go"
+	"github.com/stretchr/testify/require"
+)
+
+// writePlaintext encrypts data using devmapper userspace implementation of dm-crypt
+func writePlaintext(t *testing.T, v *Volume, path string, data []byte) {
+	table := devmapper.CryptTable{
+		Length:        v.StorageSize - v.StorageSize%v.StorageSectorSize,
+		BackendDevice: path,
+		BackendOffset: v.StorageOffset,
+		Encryption:    v.StorageEncryption,
+		Key:           v.key,
+		SectorSize:    v.StorageSectorSize,
+	}
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDWR, 0, table)
+	require.NoError(t, err)
+	defer vol.Close()
+
+	_, err = vol.WriteAt(data, 0)
+	require.NoError(t, err)
+}
+
+func runVolumeReaderTest(t *testing.T, diskSize int64, opts *FormatOptions) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, diskSize)
+	dev, err := Format(disk.Name(), []byte(password), opts)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	// a partial sector at the end of the disk is not readable
+	size := v.StorageSize - v.StorageSize%v.StorageSectorSize
+	data := make([]byte, size)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	writePlaintext(t, v, disk.Name(), data)
+
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+
+	ra, err := v.NewReaderAt()
+	require.NoError(t, err)
+
+	// unaligned read in the middle of the volume
+	buf := make([]byte, 10000)
+	n, err := ra.ReadAt(buf, 5000)
+	require.NoError(t, err)
+	require.Equal(t, len(buf), n)
+	require.Equal(t, data[5000:15000], buf)
+
+	// read beyond the end of the volume
+	n, err = ra.ReadAt(buf, int64(size)-100)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, data[len(data)-100:], buf[:n])
+
+	_, err = ra.ReadAt(buf, int64(size))
+	require.Equal(t, io.EOF, err)
+}
+
+func TestVolumeReaderLuks1(t *testing.T) {
+	runVolumeReaderTest(t, 4*1024*1024, &FormatOptions{Version: 1, KDF: testKdf})
+}
+
+func TestVolumeReaderLuks2(t *testing.T) {
+	runVolumeReaderTest(t, 24*1024*1024, &FormatOptions{KDF: testKdf})
+}
+
+func TestVolumeReaderLuks2SectorSize(t *testing.T) {
+	runVolumeReaderTest(t, 24*1024*1024, &FormatOptions{SectorSize: 4096, KDF: testKdf})
+}
+
+func TestVolumeReaderUnalignedSize(t *testing.T) {
+	runVolumeReaderTest(t, 24*1024*1024+512, &FormatOptions{SectorSize: 4096, KDF: testKdf})
+}
+
+func TestVolumeReaderOpenReaderAt(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	data := []byte("Hello, world!")
+	writePlaintext(t, v, disk.Name(), append(data, make([]byte, 512-len(data))...))
+
+	image, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	d, err := OpenReaderAt(bytes.NewReader(image), int64(len(image)))
+	require.NoError(t, err)
+	defer d.Close()
+
+	v, err = d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+}
+
+// readPlaintext decrypts data using devmapper userspace implementation of dm-crypt
+func readPlaintext(t *testing.T, v *Volume, path string) []byte {
+	table := devmapper.CryptTable{
+		Length:        v.StorageSize,
+		BackendDevice: path,
+		BackendOffset: v.StorageOffset,
+		Encryption:    v.StorageEncryption,
+		Key:           v.key,
+		SectorSize:    v.StorageSectorSize,
+	}
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, table)
+	require.NoError(t, err)
+	defer vol.Close()
+
+	data := make([]byte, v.StorageSize)
+	_, err = vol.ReadAt(data, 0)
+	require.NoError(t, err)
+	return data
+}
+
+func runVolumeWriterTest(t *testing.T, diskSize int64, opts *FormatOptions) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, diskSize)
+	dev, err := Format(disk.Name(), []byte(password), opts)
+	require.NoError(t, err)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+
+	data := make([]byte, v.StorageSize)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	w, err := v.NewWriterAt()
+	require.NoError(t, err)
+	n, err := w.WriteAt(data, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	// unaligned writes modify parts of sectors
+	for _, off := range []int{0, 100, 4000, 4096, 8190, len(data) - 10} {
+		chunk := []byte("unaligned write")
+		if off+len(chunk) > len(data) {
+			chunk = chunk[:len(data)-off]
+		}
+		n, err := w.WriteAt(chunk, int64(off))
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+		copy(data[off:], chunk)
+	}
+
+	_, err = w.WriteAt([]byte("foo"), int64(len(data)))
+	require.Error(t, err)
+	n, err = w.WriteAt([]byte("foobar"), int64(len(data))-3)
+	require.Error(t, err)
+	require.Equal(t, 3, n)
+	copy(data[len(data)-3:], "foo")
+	require.NoError(t, w.Close())
+
+	if v.StorageEncryption == "aes-xts-plain64" {
+		// devmapper userspace implementation supports only this mode
+		require.True(t, bytes.Equal(data, readPlaintext(t, v, disk.Name())))
+	}
+
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+}
+
+func TestVolumeWriterLuks1(t *testing.T) {
+	runVolumeWriterTest(t, 4*1024*1024, &FormatOptions{Version: 1, KDF: testKdf})
+}
+
+func TestVolumeWriterLuks2(t *testing.T) {
+	runVolumeWriterTest(t, 24*1024*1024, &FormatOptions{KDF: testKdf})
+}
+
+func TestVolumeWriterLuks2SectorSize(t *testing.T) {
+	runVolumeWriterTest(t, 24*1024*1024, &FormatOptions{SectorSize: 4096, KDF: testKdf})
+}
+
+func TestVolumeWriterLuks1CbcEssiv(t *testing.T) {
+	runVolumeWriterTest(t, 4*1024*1024, &FormatOptions{Version: 1, Cipher: "aes-cbc-essiv:sha256", KeySize: 256, KDF: testKdf})
+}
+
+func TestVolumeWriterLuks2CbcPlain64(t *testing.T) {
+	runVolumeWriterTest(t, 24*1024*1024, &FormatOptions{Cipher: "aes-cbc-plain64", KeySize: 256, SectorSize: 4096, KDF: testKdf})
+}
+
+func TestVolumeWriterLuks2XtsPlain(t *testing.T) {
+	runVolumeWriterTest(t, 24*1024*1024, &FormatOptions{Cipher: "twofish-xts-plain", KDF: testKdf})
+}
+
+func TestVolumeWriterReadOnly(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	require.NoError(t, dev.Close())
+
+	image, err := os.ReadFile(disk.Name())
+	require.NoError(t, err)
+	d, err := OpenReaderAt(bytes.NewReader(image), int64(len(image)))
+	require.NoError(t, err)
+	defer d.Close()
+
+	v, err := d.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	_, err = v.NewWriterAt()
+	require.Error(t, err)
+}
+
+// prepareMultiSegmentDisk formats a LUKS2 disk and splits its data into encrypted segments with different
+// sector sizes, an unencrypted hole between them and a reencryption backup segment
+func prepareMultiSegmentDisk(t *testing.T, password string) (*os.File, Device) {
+	disk := prepareEmptyDisk(t, 24*1024*1024)
+	dev, err := Format(disk.Name(), []byte(password), &FormatOptions{KDF: testKdf})
+	require.NoError(t, err)
+	d := dev.(*deviceV2)
+
+	seg := d.meta.Segments[0]
+	offset, err := seg.Offset.Int64()
+	require.NoError(t, err)
+	const mb = 1024 * 1024
+	d.meta.Segments = map[int]segment{
+		0: {Type: "crypt", Offset: jsonNumber(uint64(offset)), IvTweak: "0", Size: "2097152", Encryption: seg.Encryption, SectorSize: 512},
+		1: {Type: "linear", Offset: jsonNumber(uint64(offset) + 2*mb), Size: "1048576"},
+		2: {Type: "crypt", Offset: jsonNumber(uint64(offset) + 3*mb), IvTweak: "0", Size: "dynamic", Encryption: seg.Encryption, SectorSize: 4096},
+		3: {Type: "crypt", Offset: jsonNumber(uint64(offset)), IvTweak: "0", Size: "dynamic", Encryption: seg.Encryption, SectorSize: 4096, Flags: []string{"backup-final"}},
+	}
+	dig := d.meta.Digests[0]
+	dig.Segments = quotedNumbers{"0", "2", "3"}
+	d.meta.Digests[0] = dig
+	require.NoError(t, d.writeHeaders(disk))
+	require.NoError(t, dev.Close())
+
+	dev, err = Open(disk.Name())
+	require.NoError(t, err)
+	return disk, dev
+}
+
+func TestVolumeMultiSegment(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	disk, dev := prepareMultiSegmentDisk(t, password)
+	defer dev.Close()
+
+	v, err := dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+	require.Len(t, v.Segments, 3)
+	const mb = 1024 * 1024
+	offset := v.StorageOffset
+	require.Equal(t, VolumeSegment{Type: SegmentCrypt, Encryption: "aes-xts-plain64", SectorSize: 512, Offset: offset, Size: 2 * mb}, v.Segments[0])
+	require.Equal(t, VolumeSegment{Type: SegmentLinear, SectorSize: 512, Offset: offset + 2*mb, Size: mb}, v.Segments[1])
+	require.Equal(t, VolumeSegment{Type: SegmentCrypt, Encryption: "aes-xts-plain64", SectorSize: 4096, Offset: offset + 3*mb, Size: 24*mb - offset - 3*mb}, v.Segments[2])
+	require.Equal(t, uint64(2*mb), v.StorageSize)
+
+	data := make([]byte, v.size())
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	w, err := v.NewWriterAt()
+	require.NoError(t, err)
+	n, err := w.WriteAt(data, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	// a write that spans all the segments
+	chunk := bytes.Repeat([]byte("multi-segment write"), mb/4)
+	_, err = w.WriteAt(chunk, 2*mb-100)
+	require.NoError(t, err)
+	copy(data[2*mb-100:], chunk)
+	require.NoError(t, w.Close())
+
+	// the hole keeps the data unencrypted
+	hole := make([]byte, mb)
+	_, err = disk.ReadAt(hole, int64(offset+2*mb))
+	require.NoError(t, err)
+	require.Equal(t, data[2*mb:3*mb], hole)
+
+	r, err := v.NewReader()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), r.Size())
+	decrypted, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, decrypted))
+
+	// the device mapper table decrypts the same data
+	tables, err := v.mapperTables(nil)
+	require.NoError(t, err)
+	require.Equal(t, []devmapper.Table{
+		devmapper.CryptTable{Length: 2 * mb, BackendDevice: disk.Name(), BackendOffset: offset, Encryption: "aes-xts-plain64", Key: v.key, SectorSize: 512},
+		devmapper.LinearTable{Start: 2 * mb, Length: mb, BackendDevice: disk.Name(), BackendOffset: offset + 2*mb},
+		devmapper.CryptTable{Start: 3 * mb, Length: v.Segments[2].Size, BackendDevice: disk.Name(), BackendOffset: offset + 3*mb, Encryption: "aes-xts-plain64", Key: v.key, SectorSize: 4096},
+	}, tables)
+	vol, err := devmapper.OpenUserspaceVolume(os.O_RDONLY, 0, tables...)
+	require.NoError(t, err)
+	defer vol.Close()
+	mapped := make([]byte, len(data))
+	_, err = vol.ReadAt(mapped, 0)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, mapped))
+}
+
+func TestVolumeMultiSegmentInvalid(t *testing.T) {
+	t.Parallel()
+
+	password := "foobar"
+	_, dev := prepareMultiSegmentDisk(t, password)
+	defer dev.Close()
+	d := dev.(*deviceV2)
+
+	// the segment is encrypted with another key, e.g. the old key while reencryption is in progress
+	dig := d.meta.Digests[0]
+	dig.Segments = quotedNumbers{"0", "3"}
+	d.meta.Digests[0] = dig
+	_, err := dev.UnsealVolume(0, []byte(password))
+	require.Error(t, err)
+	dig.Segments = quotedNumbers{"0", "2", "3"}
+	d.meta.Digests[0] = dig
+
+	seg := d.meta.Segments[0]
+	seg.Size = "dynamic"
+	d.meta.Segments[0] = seg
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.Error(t, err)
+	seg.Size = "1000"
+	d.meta.Segments[0] = seg
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.Error(t, err)
+	seg.Size = "2097152"
+	d.meta.Segments[0] = seg
+
+	_, err = dev.UnsealVolume(0, []byte(password))
+	require.NoError(t, err)
+}